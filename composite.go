@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+// compositeLayer returns the layer holding the subtree of the observed
+// composite resource loaded by the supplied source, if any.
+func compositeLayer(config v1beta1.EnvironmentSource, xr *resource.Composite) (*envLayer, error) {
+	if config.Composite == nil {
+		return nil, errors.New("composite is required")
+	}
+	if len(config.Composite.AllowedKeys) == 0 {
+		return nil, errors.New("composite.allowedKeys is required")
+	}
+	path := config.Composite.FromFieldPath
+	v, err := fieldpath.Pave(xr.Resource.Object).GetValue(path)
+	if fieldpath.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get value at %q", path)
+	}
+	data, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.Errorf("value at %q is a %s, not an object", path, jsonType(v))
+	}
+	if denied := deniedKeys(config.Composite.AllowedKeys, "", data); len(denied) > 0 {
+		return nil, errors.Errorf("keys not allowed at %q: %s", path, strings.Join(denied, ", "))
+	}
+	return &envLayer{
+		kind:        layerKindComposite,
+		data:        runtime.DeepCopyJSON(data),
+		toFieldPath: ptr.Deref(config.ToFieldPath, ""),
+		priority:    ptr.Deref(config.Priority, 0),
+	}, nil
+}
+
+// deniedKeys returns the paths of the values of the supplied object, found at
+// path, that are neither allowed nor enclosing allowed ones.
+func deniedKeys(allowed []string, path string, obj map[string]any) []string {
+	var out []string
+	for k, v := range obj {
+		p := appendPath(path, k)
+		if slices.ContainsFunc(allowed, func(a string) bool { return isPathUnder(p, a) }) {
+			continue
+		}
+		nested, ok := v.(map[string]any)
+		if ok && slices.ContainsFunc(allowed, func(a string) bool { return isPathUnder(a, p) }) {
+			out = append(out, deniedKeys(allowed, p, nested)...)
+			continue
+		}
+		out = append(out, p)
+	}
+	slices.Sort(out)
+	return out
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composite"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+func TestCompositeLayer(t *testing.T) {
+	xr := &resource.Composite{Resource: &composite.Unstructured{}}
+	xr.Resource.Object = map[string]any{
+		"spec": map[string]any{
+			"parameters": map[string]any{
+				"overrides": map[string]any{
+					"replicas": int64(3),
+					"network":  map[string]any{"cidr": "10.0.0.0/16", "zone": "a"},
+				},
+				"name": "example",
+			},
+		},
+	}
+
+	type args struct {
+		config v1beta1.EnvironmentSource
+	}
+	type want struct {
+		layer *envLayer
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Subtree": {
+			reason: "The subtree of the composite resource should be loaded at toFieldPath",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Composite: &v1beta1.CompositeSource{
+						FromFieldPath: "spec.parameters.overrides",
+						AllowedKeys:   []string{"replicas", "network"},
+					},
+					ToFieldPath: ptr.To("overrides"),
+				},
+			},
+			want: want{
+				layer: &envLayer{
+					kind: layerKindComposite,
+					data: map[string]any{
+						"replicas": int64(3),
+						"network":  map[string]any{"cidr": "10.0.0.0/16", "zone": "a"},
+					},
+					toFieldPath: "overrides",
+				},
+			},
+		},
+		"AllowedKeys": {
+			reason: "Values allowed or nested under allowed keys should be loaded",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Composite: &v1beta1.CompositeSource{
+						FromFieldPath: "spec.parameters.overrides",
+						AllowedKeys:   []string{"replicas", "network.cidr", "network.zone"},
+					},
+				},
+			},
+			want: want{
+				layer: &envLayer{
+					kind: layerKindComposite,
+					data: map[string]any{
+						"replicas": int64(3),
+						"network":  map[string]any{"cidr": "10.0.0.0/16", "zone": "a"},
+					},
+				},
+			},
+		},
+		"DeniedKeys": {
+			reason: "Values outside of the allowed keys should return an error",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Composite: &v1beta1.CompositeSource{
+						FromFieldPath: "spec.parameters.overrides",
+						AllowedKeys:   []string{"network.cidr"},
+					},
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"NotFound": {
+			reason: "Nothing should be loaded if the composite resource does not set the subtree",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Composite: &v1beta1.CompositeSource{FromFieldPath: "spec.parameters.missing", AllowedKeys: []string{"replicas"}},
+				},
+			},
+			want: want{},
+		},
+		"NotAnObject": {
+			reason: "Values that are not objects should return an error",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Composite: &v1beta1.CompositeSource{FromFieldPath: "spec.parameters.name", AllowedKeys: []string{"replicas"}},
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"Priority": {
+			reason: "The subtree of the composite resource should be merged with the priority of the source",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Composite: &v1beta1.CompositeSource{
+						FromFieldPath: "spec.parameters.overrides",
+						AllowedKeys:   []string{"replicas", "network"},
+					},
+					Priority: ptr.To[int64](10),
+				},
+			},
+			want: want{
+				layer: &envLayer{
+					kind: layerKindComposite,
+					data: map[string]any{
+						"replicas": int64(3),
+						"network":  map[string]any{"cidr": "10.0.0.0/16", "zone": "a"},
+					},
+					priority: 10,
+				},
+			},
+		},
+		"NoAllowedKeys": {
+			reason: "Sources not listing the allowed keys should return an error",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Composite: &v1beta1.CompositeSource{FromFieldPath: "spec.parameters.overrides", AllowedKeys: []string{}},
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := compositeLayer(tc.args.config, xr)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\ncompositeLayer(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.layer, got, cmp.AllowUnexported(envLayer{})); diff != "" {
+				t.Errorf("%s\ncompositeLayer(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestDeniedKeys(t *testing.T) {
+	obj := map[string]any{
+		"replicas": int64(3),
+		"network":  map[string]any{"cidr": "10.0.0.0/16", "zone": "a"},
+		"image":    "example",
+	}
+	got := deniedKeys([]string{"replicas", "network.cidr"}, "", obj)
+	if diff := cmp.Diff([]string{"image", "network.zone"}, got); diff != "" {
+		t.Errorf("deniedKeys(...): -want, +got:\n%s", diff)
+	}
+}
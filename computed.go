@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"cel.dev/cel-go/cel"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
+	"google.golang.org/protobuf/types/known/structpb"
+	k8sjson "k8s.io/apimachinery/pkg/util/json"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+const (
+	// celCostLimit is the maximum cost of evaluating a CEL expression, e.g.
+	// bounding comprehensions over large lists.
+	celCostLimit = 1000000
+	// celEvalTimeout is the maximum time evaluating a CEL expression can
+	// take.
+	celEvalTimeout = time.Second
+	// celInterruptCheckFrequency is how many comprehension iterations are
+	// evaluated between checks for the evaluation timeout.
+	celInterruptCheckFrequency = 100
+	// maxCachedPrograms is the maximum number of computed values whose
+	// programs are cached across invocations.
+	maxCachedPrograms = 64
+)
+
+// getPrograms returns the CEL programs of the supplied computed values,
+// compiling them only if they were not already compiled by a previous
+// invocation with the same computed values.
+func (f *Function) getPrograms(computed []v1beta1.ComputedValue) ([]cel.Program, error) {
+	raw, err := json.Marshal(computed)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal computed values")
+	}
+	sum := sha256.Sum256(raw)
+	key := hex.EncodeToString(sum[:])
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.programs[key]; ok {
+		return p, nil
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("environment", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("xr", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("context", cel.MapType(cel.StringType, cel.DynType)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create CEL environment")
+	}
+	out := make([]cel.Program, 0, len(computed))
+	for _, c := range computed {
+		ast, iss := env.Compile(c.Expression)
+		if iss.Err() != nil {
+			return nil, errors.Wrapf(iss.Err(), "cannot compile expression of %q", c.ToFieldPath)
+		}
+		p, err := env.Program(ast, cel.CostLimit(celCostLimit), cel.InterruptCheckFrequency(celInterruptCheckFrequency))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot build program of %q", c.ToFieldPath)
+		}
+		out = append(out, p)
+	}
+	if f.programs == nil {
+		f.programs = make(map[string][]cel.Program)
+	}
+	// Evict an arbitrary entry when full, computed values rarely change.
+	if len(f.programs) >= maxCachedPrograms {
+		for k := range f.programs {
+			delete(f.programs, k)
+			break
+		}
+	}
+	f.programs[key] = out
+	return out, nil
+}
+
+// computeValues evaluates the supplied programs in order, writing their
+// results to the environment at the field path of the respective computed
+// value. The origins of the computed values are tracked by the merger. The
+// values of fixed, if any, e.g. the Context environment in FillMissing mode,
+// are never overridden, neither for the following expressions.
+func computeValues(m *merger, env map[string]any, computed []v1beta1.ComputedValue, programs []cel.Program, xr, ctx, fixed map[string]any) (map[string]any, error) {
+	for i, c := range computed {
+		evalCtx, cancel := context.WithTimeout(context.Background(), celEvalTimeout)
+		val, _, err := programs[i].ContextEval(evalCtx, map[string]any{
+			"environment": env,
+			"xr":          xr,
+			"context":     ctx,
+		})
+		cancel()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot evaluate expression of %q", c.ToFieldPath)
+		}
+		native, err := val.ConvertToNative(reflect.TypeFor[*structpb.Value]())
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot convert result of %q", c.ToFieldPath)
+		}
+		raw, err := json.Marshal(native)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot marshal result of %q", c.ToFieldPath)
+		}
+		var v any
+		if err := k8sjson.Unmarshal(raw, &v); err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal result of %q", c.ToFieldPath)
+		}
+
+		p := fieldpath.Pave(env)
+		before, err := p.GetValue(c.ToFieldPath)
+		if err != nil && !fieldpath.IsNotFound(err) {
+			return nil, errors.Wrapf(err, "cannot get environment field %q", c.ToFieldPath)
+		}
+		if err := p.SetValue(c.ToFieldPath, v); err != nil {
+			return nil, errors.Wrapf(err, "cannot set environment field %q", c.ToFieldPath)
+		}
+		m.track(c.ToFieldPath, before, v, origin{kind: layerKindComputed})
+		if fixed != nil {
+			env = m.fillMissing(fixed, env, origin{kind: layerKindContext})
+		}
+	}
+	return env, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+func TestComputeValues(t *testing.T) {
+	type args struct {
+		env      map[string]any
+		computed []v1beta1.ComputedValue
+		xr       map[string]any
+		ctx      map[string]any
+		fixed    map[string]any
+	}
+	type want struct {
+		env        map[string]any
+		provenance map[string]any
+		err        error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"ComputedInOrder": {
+			reason: "Values should be computed in order from the environment, the composite resource and the context, later expressions seeing earlier results",
+			args: args{
+				env: map[string]any{
+					"cluster": map[string]any{"name": "prod", "nodes": int64(3)},
+				},
+				computed: []v1beta1.ComputedValue{
+					{ToFieldPath: "cluster.fullName", Expression: `environment.cluster.name + "-" + xr.metadata.name`},
+					{ToFieldPath: "cluster.label", Expression: `environment.cluster.fullName + "-" + context["example.org/suffix"]`},
+					{ToFieldPath: "cluster.nodes", Expression: `environment.cluster.nodes * 2`},
+					{ToFieldPath: "cluster.zones", Expression: `["a", "b"].map(z, xr.spec.region + z)`},
+				},
+				xr: map[string]any{
+					"metadata": map[string]any{"name": "example"},
+					"spec":     map[string]any{"region": "eu-west-1"},
+				},
+				ctx: map[string]any{"example.org/suffix": "x"},
+			},
+			want: want{
+				env: map[string]any{
+					"cluster": map[string]any{
+						"name":     "prod",
+						"nodes":    int64(6),
+						"fullName": "prod-example",
+						"label":    "prod-example-x",
+						"zones":    []any{"eu-west-1a", "eu-west-1b"},
+					},
+				},
+				provenance: map[string]any{
+					"cluster.fullName": map[string]any{"layer": "Computed"},
+					"cluster.label":    map[string]any{"layer": "Computed"},
+					"cluster.nodes":    map[string]any{"layer": "Computed"},
+					"cluster.zones":    map[string]any{"layer": "Computed"},
+				},
+			},
+		},
+		"EvaluationError": {
+			reason: "An expression failing to evaluate should return an error",
+			args: args{
+				env:      map[string]any{},
+				computed: []v1beta1.ComputedValue{{ToFieldPath: "a", Expression: `environment.missing`}},
+			},
+			want: want{
+				provenance: map[string]any{},
+				err:        cmpopts.AnyError,
+			},
+		},
+		"CostLimitExceeded": {
+			reason: "An expression exceeding the cost limit should return an error",
+			args: args{
+				env:      map[string]any{},
+				computed: []v1beta1.ComputedValue{{ToFieldPath: "a", Expression: `[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].map(a, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].map(b, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].map(c, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].map(d, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].map(e, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].map(f, a + b + c + d + e + f))))))`}},
+			},
+			want: want{
+				provenance: map[string]any{},
+				err:        cmpopts.AnyError,
+			},
+		},
+		"FixedValues": {
+			reason: "Computed values should never override fixed values, e.g. of the Context environment in FillMissing mode, neither for the following expressions",
+			args: args{
+				env: map[string]any{
+					"cluster": map[string]any{"name": "context", "nodes": int64(3)},
+				},
+				computed: []v1beta1.ComputedValue{
+					{ToFieldPath: "cluster.name", Expression: `"computed"`},
+					{ToFieldPath: "cluster", Expression: `{"name": "computed", "zone": "a"}`},
+					{ToFieldPath: "label", Expression: `environment.cluster.name + "-" + environment.cluster.zone`},
+				},
+				fixed: map[string]any{
+					"cluster": map[string]any{"name": "context"},
+				},
+			},
+			want: want{
+				env: map[string]any{
+					"cluster": map[string]any{"name": "context", "zone": "a"},
+					"label":   "context-a",
+				},
+				provenance: map[string]any{
+					"cluster.name": map[string]any{"layer": "Context"},
+					"cluster.zone": map[string]any{"layer": "Computed"},
+					"label":        map[string]any{"layer": "Computed"},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{}
+			programs, err := f.getPrograms(tc.args.computed)
+			if err != nil {
+				t.Fatalf("f.getPrograms(...): %v", err)
+			}
+			m := newMerger(mergeOptions{trackOrigins: true})
+			got, err := computeValues(m, tc.args.env, tc.args.computed, programs, tc.args.xr, tc.args.ctx, tc.args.fixed)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\ncomputeValues(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.env, got); diff != "" {
+				t.Errorf("%s\ncomputeValues(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.provenance, m.provenance()); diff != "" {
+				t.Errorf("%s\nm.provenance(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestGetPrograms(t *testing.T) {
+	computed := []v1beta1.ComputedValue{{ToFieldPath: "a", Expression: `"a"`}}
+
+	f := &Function{}
+	first, err := f.getPrograms(computed)
+	if err != nil {
+		t.Fatalf("f.getPrograms(...): %v", err)
+	}
+	second, err := f.getPrograms([]v1beta1.ComputedValue{{ToFieldPath: "a", Expression: `"a"`}})
+	if err != nil {
+		t.Fatalf("f.getPrograms(...): %v", err)
+	}
+	if &first[0] != &second[0] {
+		t.Errorf("f.getPrograms(...): programs compiled for the same computed values should be cached")
+	}
+
+	if _, err := f.getPrograms([]v1beta1.ComputedValue{{ToFieldPath: "a", Expression: `"a" +`}}); err == nil {
+		t.Errorf("f.getPrograms(...): an invalid expression should return an error")
+	}
+
+	for i := range 2 * maxCachedPrograms {
+		if _, err := f.getPrograms([]v1beta1.ComputedValue{{ToFieldPath: "a", Expression: fmt.Sprintf("%d", i)}}); err != nil {
+			t.Fatalf("f.getPrograms(...): %v", err)
+		}
+	}
+	if len(f.programs) > maxCachedPrograms {
+		t.Errorf("f.getPrograms(...): expected at most %d cached programs, got %d", maxCachedPrograms, len(f.programs))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sjson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+// decodeFields returns copies of the selected EnvironmentConfigs with the
+// string values at the supplied field paths parsed into structured values.
+// Values encrypted with SOPS can't be decoded, as they are only decrypted
+// once their EnvironmentConfig is merged.
+func decodeFields(fields []v1beta1.DecodeField, selected []unstructured.Unstructured) ([]unstructured.Unstructured, error) {
+	if len(fields) == 0 {
+		return selected, nil
+	}
+	out := make([]unstructured.Unstructured, 0, len(selected))
+	for _, c := range selected {
+		c = *c.DeepCopy()
+		p := fieldpath.Pave(c.Object)
+		for _, f := range fields {
+			v, err := p.GetValue(f.FieldPath)
+			if fieldpath.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot get %q of environment config %q", f.FieldPath, c.GetName())
+			}
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.Errorf("cannot decode %q of environment config %q: expected a string, got %T", f.FieldPath, c.GetName(), v)
+			}
+			decoded, err := decode(f.Format, s)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot decode %q of environment config %q as %s", f.FieldPath, c.GetName(), f.Format)
+			}
+			if err := p.SetValue(f.FieldPath, decoded); err != nil {
+				return nil, errors.Wrapf(err, "cannot set %q of environment config %q", f.FieldPath, c.GetName())
+			}
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// decode parses the supplied document.
+func decode(format v1beta1.DecodeFormat, s string) (any, error) {
+	raw := []byte(s)
+	switch format {
+	case v1beta1.DecodeFormatJSON:
+	case v1beta1.DecodeFormatYAML:
+		var err error
+		if raw, err = yaml.YAMLToJSON(raw); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("unknown decode format %q", format)
+	}
+	var out any
+	if err := k8sjson.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+const (
+	// AnnotationKeyExtends is the annotation an EnvironmentConfig can set to
+	// the name of a parent EnvironmentConfig it inherits the data of.
+	AnnotationKeyExtends = "environmentconfigs.fn.crossplane.io/extends"
+
+	// maxExtendsDepth is the maximum number of ancestors an EnvironmentConfig
+	// can have. Each ancestor, like the sources listed by an Index, takes an
+	// additional invocation of the function, and Crossplane invokes it at most
+	// 5 times to satisfy its requirements: one without any resource, one with
+	// the sources, one with the sources listed by an Index and one per
+	// ancestor after that.
+	maxExtendsDepth = 2
+)
+
+// extendsRequirementName returns the name of the requirement of the parent
+// EnvironmentConfig with the supplied name.
+func extendsRequirementName(parent string) string {
+	return "environment-config-extends-" + parent
+}
+
+// addExtendsRequirements adds to resources the requirements of the parents of
+// the EnvironmentConfigs already required, following the chain of parents one
+// more step at each invocation of the function.
+func addExtendsRequirements(resources map[string]*fnv1.ResourceSelector, requiredResources map[string][]resource.Required) {
+	for range maxExtendsDepth {
+		added := false
+		for _, name := range slices.Sorted(maps.Keys(resources)) {
+			for _, r := range requiredResources[name] {
+				parent := r.Resource.GetAnnotations()[AnnotationKeyExtends]
+				if parent == "" {
+					continue
+				}
+				if _, ok := resources[extendsRequirementName(parent)]; ok {
+					continue
+				}
+				resources[extendsRequirementName(parent)] = &fnv1.ResourceSelector{
+					ApiVersion: "apiextensions.crossplane.io/v1beta1",
+					Kind:       "EnvironmentConfig",
+					Match: &fnv1.ResourceSelector_MatchName{
+						MatchName: parent,
+					},
+				}
+				added = true
+			}
+		}
+		if !added {
+			return
+		}
+	}
+}
+
+// resolveExtends returns a copy of the supplied EnvironmentConfig whose data
+// is the data of its ancestors deep merged parent-first, followed by its own,
+// with the supplied options. The data of each EnvironmentConfig is decrypted
+// by the supplied decrypter, if any, before being merged, as SOPS encrypted
+// objects can't be decrypted once merged with each other.
+func resolveExtends(c unstructured.Unstructured, requiredResources map[string][]resource.Required, opts mergeOptions, dec *decrypter) (unstructured.Unstructured, error) {
+	chain := []unstructured.Unstructured{c}
+	names := []string{c.GetName()}
+	for cur := c; cur.GetAnnotations()[AnnotationKeyExtends] != ""; {
+		parent := cur.GetAnnotations()[AnnotationKeyExtends]
+		if slices.Contains(names, parent) {
+			return unstructured.Unstructured{}, errors.Errorf("environment configs extending each other: %s -> %s", strings.Join(names, " -> "), parent)
+		}
+		if len(names) > maxExtendsDepth {
+			return unstructured.Unstructured{}, errors.Errorf("environment config %q has more than %d ancestors: %s", c.GetName(), maxExtendsDepth, strings.Join(names, " -> "))
+		}
+		parents, ok := requiredResources[extendsRequirementName(parent)]
+		if !ok {
+			return unstructured.Unstructured{}, errors.Errorf("parent environment config %q of %q not yet required", parent, cur.GetName())
+		}
+		if len(parents) == 0 {
+			return unstructured.Unstructured{}, errors.Errorf("parent environment config %q of %q not found", parent, cur.GetName())
+		}
+		cur = *parents[0].Resource
+		chain = append(chain, cur)
+		names = append(names, parent)
+	}
+	if len(chain) == 1 {
+		return c, nil
+	}
+
+	m := newMerger(opts)
+	data := map[string]any{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		d, _ := chain[i].DeepCopy().Object["data"].(map[string]any)
+		if dec != nil {
+			dd, err := dec.decrypt(d, "")
+			if err != nil {
+				return unstructured.Unstructured{}, errors.Wrapf(err, "cannot decrypt environment config %q", chain[i].GetName())
+			}
+			d, _ = dd.(map[string]any)
+		}
+		data = m.merge(data, d, origin{kind: layerKindEnvironmentConfig, name: chain[i].GetName()})
+	}
+	// The tombstones of the child are consumed merging it over its parents,
+	// but must still delete the values set by the layers merged before it.
+	own, _ := c.DeepCopy().Object["data"].(map[string]any)
+	keepTombstones(m, data, own)
+	out := *c.DeepCopy()
+	out.Object["data"] = data
+	return out, nil
+}
+
+// keepTombstones copies the tombstones of src to dst, at the same paths.
+func keepTombstones(m *merger, dst, src map[string]any) {
+	for k, v := range src {
+		if m.isTombstone(v) {
+			dst[k] = v
+			continue
+		}
+		nested, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		if d, ok := dst[k].(map[string]any); ok {
+			keepTombstones(m, d, nested)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/logging"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/ptr"
+
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+// envConfig returns an EnvironmentConfig with the supplied name, parent and
+// data.
+func envConfig(name, parent string, data map[string]any) unstructured.Unstructured {
+	c := unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "apiextensions.crossplane.io/v1beta1",
+		"kind":       "EnvironmentConfig",
+		"data":       data,
+	}}
+	c.SetName(name)
+	if parent != "" {
+		c.SetAnnotations(map[string]string{AnnotationKeyExtends: parent})
+	}
+	return c
+}
+
+// required returns the required resources holding the supplied
+// EnvironmentConfigs as parents.
+func required(configs ...unstructured.Unstructured) map[string][]resource.Required {
+	out := map[string][]resource.Required{}
+	for _, c := range configs {
+		out[extendsRequirementName(c.GetName())] = []resource.Required{{Resource: &c}}
+	}
+	return out
+}
+
+func TestResolveExtends(t *testing.T) {
+	type args struct {
+		c        unstructured.Unstructured
+		required map[string][]resource.Required
+		opts     mergeOptions
+		dec      *decrypter
+	}
+	type want struct {
+		c   unstructured.Unstructured
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"NoParent": {
+			reason: "EnvironmentConfigs without a parent should be returned as is",
+			args: args{
+				c: envConfig("prod", "", map[string]any{"a": "b"}),
+			},
+			want: want{
+				c: envConfig("prod", "", map[string]any{"a": "b"}),
+			},
+		},
+		"ParentFirst": {
+			reason: "The data of the ancestors should be deep merged parent-first, the child winning",
+			args: args{
+				c: envConfig("prod", "base-prod", map[string]any{"a": map[string]any{"b": "prod"}}),
+				required: required(
+					envConfig("base-prod", "base", map[string]any{"a": map[string]any{"b": "base-prod", "c": "base-prod"}}),
+					envConfig("base", "", map[string]any{"a": map[string]any{"c": "base", "d": "base"}, "e": "base"}),
+				),
+			},
+			want: want{
+				c: envConfig("prod", "base-prod", map[string]any{
+					"a": map[string]any{"b": "prod", "c": "base-prod", "d": "base"},
+					"e": "base",
+				}),
+			},
+		},
+		"DeleteInherited": {
+			reason: "Children should be able to delete inherited values, keeping their tombstones to delete the values of lower layers too",
+			args: args{
+				c:        envConfig("prod", "base", map[string]any{"a": map[string]any{"$patch": "delete"}}),
+				required: required(envConfig("base", "", map[string]any{"a": "base", "b": "base"})),
+			},
+			want: want{
+				c: envConfig("prod", "base", map[string]any{"a": map[string]any{"$patch": "delete"}, "b": "base"}),
+			},
+		},
+		"Cycle": {
+			reason: "EnvironmentConfigs extending each other should return an error",
+			args: args{
+				c: envConfig("a", "b", nil),
+				required: required(
+					envConfig("b", "c", nil),
+					envConfig("c", "a", nil),
+				),
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"TooDeep": {
+			reason: "EnvironmentConfigs with too many ancestors should return an error",
+			args: args{
+				c: envConfig("0", "1", nil),
+				required: required(
+					envConfig("1", "2", nil),
+					envConfig("2", "3", nil),
+					envConfig("3", "", nil),
+				),
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"ParentNotFound": {
+			reason: "Parents required but not found should return an error",
+			args: args{
+				c:        envConfig("prod", "base", nil),
+				required: map[string][]resource.Required{extendsRequirementName("base"): {}},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"MergeOptions": {
+			reason: "Children should be able to use the delete sentinel and list merges of the environment against their parents",
+			args: args{
+				c:        envConfig("prod", "base", map[string]any{"a": "~delete", "tags": []any{"prod"}}),
+				required: required(envConfig("base", "", map[string]any{"a": "base", "b": "base", "tags": []any{"base"}})),
+				opts: mergeOptions{
+					deleteSentinel: "~delete",
+					listMerges: map[string]v1beta1.ListMerge{
+						"tags": {Path: "tags", Behavior: ptr.To(v1beta1.ListMergeBehaviorAppend)},
+					},
+				},
+			},
+			want: want{
+				c: envConfig("prod", "base", map[string]any{"a": "~delete", "b": "base", "tags": []any{"base", "prod"}}),
+			},
+		},
+		"KeepTombstones": {
+			reason: "Tombstones of children deleting values their parents don't set should be kept, to delete the values of lower layers",
+			args: args{
+				c: envConfig("prod", "base", map[string]any{
+					"a": map[string]any{"$patch": "delete"},
+					"b": map[string]any{"c": map[string]any{"$patch": "delete"}, "d": "prod"},
+				}),
+				required: required(envConfig("base", "", map[string]any{"b": map[string]any{"e": "base"}})),
+			},
+			want: want{
+				c: envConfig("prod", "base", map[string]any{
+					"a": map[string]any{"$patch": "delete"},
+					"b": map[string]any{"c": map[string]any{"$patch": "delete"}, "d": "prod", "e": "base"},
+				}),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := resolveExtends(tc.args.c, tc.args.required, tc.args.opts, tc.args.dec)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nresolveExtends(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.c, got); diff != "" {
+				t.Errorf("%s\nresolveExtends(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+// crossplaneRequirementsIterations is the number of times Crossplane calls a
+// function at most to satisfy its requirements.
+const crossplaneRequirementsIterations = 5
+
+func TestExtendsWithinRequirementsIterations(t *testing.T) {
+	// The deepest chain of sources: an Index listing an EnvironmentConfig with
+	// the maximum number of ancestors.
+	configs := map[string]unstructured.Unstructured{
+		"index": envConfig("index", "", map[string]any{
+			"environmentConfigs": []any{map[string]any{"type": "Reference", "ref": map[string]any{"name": "child"}}},
+		}),
+	}
+	parent := ""
+	for i := maxExtendsDepth; i > 0; i-- {
+		name := fmt.Sprintf("ancestor-%d", i)
+		configs[name] = envConfig(name, parent, map[string]any{"depth": name, name: "set"})
+		parent = name
+	}
+	configs["child"] = envConfig("child", parent, map[string]any{"depth": "child"})
+
+	req := &fnv1.RunFunctionRequest{
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "template.fn.crossplane.io/v1beta1",
+			"kind": "Input",
+			"spec": {
+				"environmentConfigs": [
+					{
+						"type": "Index",
+						"ref": {
+							"name": "index"
+						}
+					}
+				]
+			}
+		}`),
+		Observed: &fnv1.State{
+			Composite: &fnv1.Resource{
+				Resource: resource.MustStructJSON(`{
+					"apiVersion": "example.org/v1",
+					"kind": "XR"
+				}`),
+			},
+		},
+	}
+
+	f := &Function{log: logging.NewNopLogger()}
+	var requirements *fnv1.Requirements
+	var rsp *fnv1.RunFunctionResponse
+	for i := range crossplaneRequirementsIterations + 1 {
+		if i == crossplaneRequirementsIterations {
+			t.Fatalf("f.RunFunction(...): requirements not satisfied after %d iterations", crossplaneRequirementsIterations)
+		}
+		var err error
+		rsp, err = f.RunFunction(context.Background(), req)
+		if err != nil {
+			t.Fatalf("f.RunFunction(...): %v", err)
+		}
+		if proto.Equal(rsp.GetRequirements(), requirements) {
+			break
+		}
+		requirements = rsp.GetRequirements()
+		req.RequiredResources = map[string]*fnv1.Resources{}
+		for name, sel := range requirements.GetResources() {
+			items := &fnv1.Resources{}
+			if c, ok := configs[sel.GetMatchName()]; ok {
+				s, err := structpb.NewStruct(c.Object)
+				if err != nil {
+					t.Fatalf("structpb.NewStruct(...): %v", err)
+				}
+				items.Items = append(items.Items, &fnv1.Resource{Resource: s})
+			}
+			req.RequiredResources[name] = items
+		}
+	}
+
+	env := rsp.GetContext().GetFields()[FunctionContextKeyEnvironment].GetStructValue().AsMap()
+	want := map[string]any{"depth": "child"}
+	for i := 1; i <= maxExtendsDepth; i++ {
+		want[fmt.Sprintf("ancestor-%d", i)] = "set"
+	}
+	for k, v := range want {
+		if diff := cmp.Diff(v, env[k]); diff != "" {
+			t.Errorf("f.RunFunction(...): environment key %q: -want, +got:\n%s", k, diff)
+		}
+	}
+}
+
+func TestResolveExtendsDecrypt(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both EnvironmentConfigs hold a SOPS encrypted object at the same path,
+	// which can't be decrypted once merged.
+	c := envConfig("prod", "base", map[string]any{
+		"credentials": sopsEncrypt(t, id.Recipient(), map[string]any{"password": "prod"}),
+	})
+	parent := envConfig("base", "", map[string]any{
+		"credentials": sopsEncrypt(t, id.Recipient(), map[string]any{"password": "base", "username": "admin"}),
+	})
+
+	dec := &decrypter{identities: []age.Identity{id}}
+	got, err := resolveExtends(c, required(parent), mergeOptions{}, dec)
+	if err != nil {
+		t.Fatalf("resolveExtends(...): %v", err)
+	}
+	want := envConfig("prod", "base", map[string]any{
+		"credentials": map[string]any{"password": "prod", "username": "admin"},
+	})
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("resolveExtends(...): -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]any{"credentials": map[string]any{"password": redacted, "username": redacted}}, dec.redact(got.Object["data"].(map[string]any))); diff != "" {
+		t.Errorf("dec.redact(...): -want, +got:\n%s", diff)
+	}
+}
@@ -5,10 +5,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"maps"
+	"math"
 	"reflect"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
+	"cel.dev/cel-go/cel"
+	"filippo.io/age"
+	xpv1 "github.com/crossplane/crossplane-runtime/v2/apis/common/v1"
 	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
 	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
 	"github.com/crossplane/crossplane-runtime/v2/pkg/logging"
@@ -16,6 +23,7 @@ import (
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
 
 	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
 	"github.com/crossplane/function-sdk-go/request"
@@ -28,18 +36,53 @@ import (
 const (
 	// FunctionContextKeyEnvironment is a well-known Context key where the computed Environment
 	// will be stored, so that Crossplane and other functions can access it, e.g. function-patch-and-transform.
-	FunctionContextKeyEnvironment = "apiextensions.crossplane.io/environment"
+	FunctionContextKeyEnvironment = v1beta1.DefaultEnvironmentContextKey
+
+	// AnnotationKeyPriority is the annotation an EnvironmentConfig can set to
+	// declare the priority it should be merged with, unless the source
+	// selecting it specifies a PriorityFieldPath.
+	AnnotationKeyPriority = "environmentconfigs.fn.crossplane.io/priority"
 )
 
+// envLayer is a piece of data, e.g. the data of an EnvironmentConfig selected
+// by one of the EnvironmentSources, ready to be merged into the environment.
+type envLayer struct {
+	// kind of the layer.
+	kind layerKind
+	// source is the index of the EnvironmentSource the data comes from, only
+	// meaningful for EnvironmentConfig layers.
+	source int
+	// name of the EnvironmentConfig(s) the data comes from.
+	name string
+	// data to be loaded into the environment.
+	data any
+	// toFieldPath is where in the environment the data is loaded.
+	toFieldPath string
+	// priority of the layer, higher priorities are merged last and therefore
+	// win over lower ones.
+	priority int64
+	// patchType, if set, makes data a patch to be applied to the merged
+	// environment instead of being merged into it.
+	patchType v1beta1.PatchType
+}
+
 // Function returns whatever response you ask it to.
 type Function struct {
 	fnv1.UnimplementedFunctionRunnerServiceServer
 
 	log logging.Logger
+
+	// identities decrypt the SOPS encrypted data of EnvironmentConfigs.
+	identities []age.Identity
+
+	// mu guards programs, the CEL programs of computed values compiled by
+	// previous invocations, keyed by the hash of the computed values.
+	mu       sync.Mutex
+	programs map[string][]cel.Program
 }
 
 // RunFunction runs the Function.
-func (f *Function) RunFunction(_ context.Context, req *fnv1.RunFunctionRequest) (*fnv1.RunFunctionResponse, error) { //nolint:gocyclo // TODO(phisco): refactor
+func (f *Function) RunFunction(_ context.Context, req *fnv1.RunFunctionRequest) (*fnv1.RunFunctionResponse, error) {
 	f.log.Debug("Running function", "tag", req.GetMeta().GetTag())
 
 	rsp := response.To(req, response.DefaultTTL)
@@ -50,7 +93,13 @@ func (f *Function) RunFunction(_ context.Context, req *fnv1.RunFunctionRequest)
 		return rsp, nil
 	}
 
-	if in.Spec.EnvironmentConfigs == nil {
+	envs, err := getEnvironments(in)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "invalid environments"))
+		return rsp, nil
+	}
+
+	if len(envs) == 0 {
 		f.log.Debug("No EnvironmentConfigs specified, exiting")
 		return rsp, nil
 	}
@@ -61,9 +110,15 @@ func (f *Function) RunFunction(_ context.Context, req *fnv1.RunFunctionRequest)
 		return rsp, nil
 	}
 
+	requiredResources, err := request.GetRequiredResources(req)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot get required resources from %T", req))
+		return rsp, nil
+	}
+
 	// Note(phisco): We need to compute the selectors even if we already
 	// requested them already at the previous iteration.
-	requirements, err := buildRequirements(in, oxr)
+	requirements, err := buildRequirements(envs, oxr, requiredResources)
 	if err != nil {
 		response.Fatal(rsp, errors.Wrapf(err, "cannot build requirements"))
 		return rsp, nil
@@ -71,52 +126,301 @@ func (f *Function) RunFunction(_ context.Context, req *fnv1.RunFunctionRequest)
 
 	rsp.Requirements = requirements
 
-	if req.RequiredResources == nil {
+	// Inputs whose sources are all inline or loaded from the composite
+	// resource don't require any resource, so Crossplane never sends any.
+	if req.RequiredResources == nil && len(requirements.GetResources()) > 0 {
 		f.log.Debug("No required resources specified, exiting", "requirements", rsp.GetRequirements())
 		return rsp, nil
 	}
 
+	// Some requirements, e.g. the parents of EnvironmentConfigs, are only
+	// known once others have been satisfied, so they are satisfied at a later
+	// iteration.
+	if pending := pendingRequirements(requirements, requiredResources); len(pending) > 0 {
+		f.log.Debug("Required resources not yet satisfied, exiting", "pending", pending)
+		return rsp, nil
+	}
+
+	// The desired composite and composed resources are only written if any
+	// environment writes to them, once all environments have been computed.
+	d := &desired{}
+	if slices.ContainsFunc(envs, environment.writesComposite) {
+		d.xr, err = request.GetDesiredCompositeResource(req)
+		if err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot get desired composite resource"))
+			return rsp, nil
+		}
+	}
+	if slices.ContainsFunc(envs, environment.writesComposed) {
+		d.composed, err = request.GetDesiredComposedResources(req)
+		if err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot get desired composed resources"))
+			return rsp, nil
+		}
+	}
+
+	for _, env := range envs {
+		if err := f.computeEnvironment(req, rsp, env, oxr, requiredResources, d); err != nil {
+			response.Fatal(rsp, env.wrap(err))
+			return rsp, nil
+		}
+	}
+
+	if d.xr != nil {
+		if err := response.SetDesiredCompositeResource(rsp, d.xr); err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot set desired composite resource"))
+			return rsp, nil
+		}
+	}
+	if d.composed != nil {
+		if err := response.SetDesiredComposedResources(rsp, d.composed); err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot set desired composed resources"))
+			return rsp, nil
+		}
+	}
+
+	return rsp, nil
+}
+
+// desired is the desired state environments write to, if any.
+type desired struct {
+	xr       *resource.Composite
+	composed map[resource.Name]*resource.DesiredComposed
+}
+
+// An environment to be computed and written to its Context key.
+type environment struct {
+	// name of the environment, empty for the one specified at the top level
+	// of the Input.
+	name string
+	spec *v1beta1.EnvironmentSpec
+}
+
+// requirementName returns the name of the requirement of the i-th source of
+// the environment.
+func (e environment) requirementName(i int) string {
+	if e.name == "" {
+		return fmt.Sprintf("environment-config-%d", i)
+	}
+	return fmt.Sprintf("environment-%s-config-%d", e.name, i)
+}
+
+// indexRequirementName returns the name of the requirement of the j-th source
+// listed by the index that is the i-th source of the environment.
+func (e environment) indexRequirementName(i, j int) string {
+	return fmt.Sprintf("%s-%d", e.requirementName(i), j)
+}
+
+// schemaRequirementName returns the name of the requirement of the
+// EnvironmentConfig holding the schema of the environment.
+func (e environment) schemaRequirementName() string {
+	if e.name == "" {
+		return "environment-schema"
+	}
+	return fmt.Sprintf("environment-%s-schema", e.name)
+}
+
+// writesComposite returns true if the environment writes to the desired
+// composite resource.
+func (e environment) writesComposite() bool {
+	return len(e.spec.Exports) > 0 || (e.spec.Provenance != nil && e.spec.Provenance.ToCompositeFieldPath != nil)
+}
+
+// writesComposed returns true if the environment writes a desired composed
+// resource.
+func (e environment) writesComposed() bool {
+	return e.spec.Output != nil
+}
+
+// wrap wraps the supplied error with the name of the environment, if any.
+func (e environment) wrap(err error) error {
+	if e.name == "" {
+		return err
+	}
+	return errors.Wrapf(err, "environment %q", e.name)
+}
+
+// getEnvironments returns the environments specified by the Input. The
+// top-level one is only returned if it selects EnvironmentConfigs.
+func getEnvironments(in *v1beta1.Input) ([]environment, error) {
+	envs := make([]environment, 0, len(in.Spec.Environments)+1)
+	if in.Spec.EnvironmentConfigs != nil {
+		envs = append(envs, environment{spec: &in.Spec.EnvironmentSpec})
+	}
+	names := make(map[string]bool, len(in.Spec.Environments))
+	for i := range in.Spec.Environments {
+		e := &in.Spec.Environments[i]
+		if e.Name == "" {
+			return nil, errors.Errorf("name of environment %d is required", i)
+		}
+		if names[e.Name] {
+			return nil, errors.Errorf("environment %q specified more than once", e.Name)
+		}
+		names[e.Name] = true
+		if e.ContextKey == nil {
+			return nil, errors.Errorf("contextKey of environment %q is required", e.Name)
+		}
+		envs = append(envs, environment{name: e.Name, spec: &e.EnvironmentSpec})
+	}
+	keys := make(map[string]bool, len(envs))
+	outputs := make(map[string]bool, len(envs))
+	for _, e := range envs {
+		if keys[e.spec.GetContextKey()] {
+			return nil, errors.Errorf("context key %q used by more than one environment", e.spec.GetContextKey())
+		}
+		keys[e.spec.GetContextKey()] = true
+	}
+	// Provenance is written to the Context too, once all the environments
+	// have claimed their keys.
+	for _, e := range envs {
+		if key := e.spec.Provenance.GetContextKey(); key != "" {
+			if keys[key] {
+				return nil, errors.Errorf("provenance context key %q used by more than one environment", key)
+			}
+			keys[key] = true
+		}
+		if !e.writesComposed() {
+			continue
+		}
+		if outputs[e.spec.Output.GetResourceName()] {
+			return nil, errors.Errorf("output resource name %q used by more than one environment", e.spec.Output.GetResourceName())
+		}
+		outputs[e.spec.Output.GetResourceName()] = true
+	}
+	return envs, nil
+}
+
+// computeEnvironment computes the supplied environment from its sources and
+// writes it to its Context key and to the desired state, if requested.
+func (f *Function) computeEnvironment(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, env environment, oxr *resource.Composite, requiredResources map[string][]resource.Required, d *desired) error { //nolint:gocyclo // TODO(phisco): refactor
+	spec := env.spec
+	key := spec.GetContextKey()
+
 	var inputEnv *unstructured.Unstructured
-	if v, ok := request.GetContextKey(req, FunctionContextKeyEnvironment); ok {
+	if v, ok := request.GetContextKey(req, key); ok {
 		inputEnv = &unstructured.Unstructured{}
 		if err := resource.AsObject(v.GetStructValue(), inputEnv); err != nil {
-			response.Fatal(rsp, errors.Wrapf(err, "cannot get Composition environment from %T context key %q", req, FunctionContextKeyEnvironment))
-			return rsp, nil
+			return errors.Wrapf(err, "cannot get Composition environment from %T context key %q", req, key)
 		}
-		f.log.Debug("Loaded Composition environment from Function context", "context-key", FunctionContextKeyEnvironment)
+		f.log.Debug("Loaded Composition environment from Function context", "context-key", key)
 	}
 
-	requiredResources, err := request.GetRequiredResources(req)
+	listMerges, err := getListMerges(spec)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrapf(err, "cannot get required resources from %T", req))
-		return rsp, nil
+		return errors.Wrapf(err, "invalid list merges")
+	}
+	opts := mergeOptions{
+		deleteSentinel: ptr.Deref(spec.DeleteSentinel, ""),
+		listMerges:     listMerges,
+	}
+
+	// Values are only decrypted if age identities are configured, so that
+	// data merely looking encrypted is merged as is otherwise.
+	var dec *decrypter
+	if len(f.identities) > 0 {
+		dec = &decrypter{identities: f.identities}
 	}
 
-	envConfigs, err := getSelectedEnvConfigs(in, requiredResources)
+	envConfigs, err := getSelectedEnvConfigs(env, oxr, requiredResources, opts, dec)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrapf(err, "cannot get selected environment configs"))
-		return rsp, nil
+		return errors.Wrapf(err, "cannot get selected environment configs")
 	}
 
-	mergedData, err := mergeEnvConfigsData(envConfigs)
+	layers, patches, err := orderLayers(spec, inputEnv, envConfigs)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrapf(err, "cannot merge environment data"))
-		return rsp, nil
+		return errors.Wrapf(err, "cannot order environment layers")
+	}
+
+	opts.trackOrigins = tracksOrigins(spec)
+	m := newMerger(opts)
+	mergedData, err := mergeEnvConfigsData(m, dec, layers)
+	if err != nil {
+		return errors.Wrapf(err, "cannot merge environment data")
+	}
+
+	warnings, errs := classifyConflicts(spec, m.conflicts)
+	if len(errs) > 0 {
+		return errors.Errorf("conflicting environment values: %s", strings.Join(errs, "; "))
+	}
+	if len(warnings) > 0 {
+		response.Warning(rsp, env.wrap(errors.Errorf("conflicting environment values: %s", strings.Join(warnings, "; "))))
+	}
+
+	if tc := spec.TypeCheck; tc != nil {
+		if changes := filterTypeChanges(tc, m.typeChanges); len(changes) > 0 {
+			err := errors.Errorf("environment values changing type: %s", strings.Join(changes, "; "))
+			if tc.GetPolicy() == v1beta1.ViolationPolicyError {
+				return err
+			}
+			response.Warning(rsp, env.wrap(err))
+		}
 	}
 
-	// merge input env if any (merged EnvironmentConfigs data  > default data > input env)
-	if inputEnv != nil {
-		mergedData = mergeMaps(inputEnv.Object, mergedData)
+	mergedData, err = applyPatches(m, mergedData, patches, spec.Patches)
+	if err != nil {
+		return errors.Wrapf(err, "cannot patch environment")
+	}
+
+	// In FillMissing mode the values of the Context environment are never
+	// overridden, neither by the values computed below.
+	var fixed map[string]any
+	if inputEnv != nil && spec.GetMergeMode() == v1beta1.MergeModeFillMissing {
+		fixed = inputEnv.Object
+		mergedData = m.fillMissing(fixed, mergedData, origin{kind: layerKindContext})
 	}
 
-	// merge default data if any (merged EnvironmentConfigs data  > default data > input env)
-	if in.Spec.DefaultData != nil {
-		defaultData, err := unmarshalData(in.Spec.DefaultData)
+	if ptr.Deref(spec.RenderTemplates, false) {
+		mergedData, err = renderTemplates(m, mergedData, oxr.Resource.Object)
 		if err != nil {
-			response.Fatal(rsp, errors.Wrapf(err, "cannot unmarshal default data"))
-			return rsp, nil
+			return errors.Wrap(err, "cannot render templates")
+		}
+	}
+
+	if len(spec.Computed) > 0 {
+		programs, err := f.getPrograms(spec.Computed)
+		if err != nil {
+			return errors.Wrap(err, "invalid computed values")
+		}
+		mergedData, err = computeValues(m, mergedData, spec.Computed, programs, oxr.Resource.Object, req.GetContext().AsMap(), fixed)
+		if err != nil {
+			return errors.Wrap(err, "cannot compute values")
+		}
+	}
+
+	if len(spec.RequiredKeys) > 0 {
+		missing, err := checkRequiredKeys(spec.RequiredKeys, mergedData)
+		if err != nil {
+			return errors.Wrap(err, "cannot check required keys")
+		}
+		if len(missing) > 0 {
+			sources := slices.Concat(layers, patches)
+			if fixed != nil {
+				sources = append(sources, envLayer{kind: layerKindContext})
+			}
+			return errors.Errorf("required environment keys not satisfied: %s; consulted sources: %s", strings.Join(missing, "; "), describeSources(sources))
+		}
+	}
+
+	if spec.Schema != nil {
+		schema, err := getSchema(env, requiredResources)
+		if err != nil {
+			return errors.Wrap(err, "cannot get environment schema")
+		}
+		if violations := validateSchema(schema, environmentData(mergedData)); len(violations) > 0 {
+			err := errors.Errorf("environment does not match schema: %s", strings.Join(violations, "; "))
+			if spec.Schema.GetPolicy() == v1beta1.ViolationPolicyError {
+				return err
+			}
+			response.Warning(rsp, env.wrap(err))
+		}
+	}
+
+	if spec.Output != nil {
+		cd, err := buildOutput(spec.Output, mergedData)
+		if err != nil {
+			return errors.Wrap(err, "cannot build environment output")
 		}
-		mergedData = mergeMaps(defaultData, mergedData)
+		d.composed[resource.Name(spec.Output.GetResourceName())] = &resource.DesiredComposed{Resource: cd, Ready: resource.ReadyTrue}
 	}
 
 	// build environment and return it in the response as context
@@ -126,55 +430,606 @@ func (f *Function) RunFunction(_ context.Context, req *fnv1.RunFunctionRequest)
 	}
 	v, err := resource.AsStruct(out)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrap(err, "cannot convert Composition environment to protobuf Struct well-known type"))
-		return rsp, nil
+		return errors.Wrap(err, "cannot convert Composition environment to protobuf Struct well-known type")
 	}
-	f.log.Debug("Computed Composition environment", "environment", v)
-	response.SetContextKey(rsp, FunctionContextKeyEnvironment, structpb.NewStructValue(v))
+	// Decrypted values are kept out of the logs.
+	f.log.Debug("Computed Composition environment", "context-key", key, "environment", dec.redact(out.Object))
+	response.SetContextKey(rsp, key, structpb.NewStructValue(v))
 
-	return rsp, nil
+	if spec.Provenance != nil {
+		if err := writeProvenance(rsp, d.xr, spec.Provenance, m.provenance()); err != nil {
+			return errors.Wrap(err, "cannot write environment provenance")
+		}
+	}
+
+	if err := exportFields(d.xr, mergedData, spec.Exports); err != nil {
+		return errors.Wrap(err, "cannot export environment fields")
+	}
+
+	return nil
+}
+
+// tracksOrigins returns true if computing the supplied environment needs the
+// origins of its values, i.e. to report provenance, conflicts or type changes,
+// or to render templates.
+func tracksOrigins(spec *v1beta1.EnvironmentSpec) bool {
+	if spec.Provenance != nil || spec.TypeCheck != nil || ptr.Deref(spec.RenderTemplates, false) {
+		return true
+	}
+	if ptr.Deref(spec.ConflictPolicy, v1beta1.ConflictPolicyOverride) != v1beta1.ConflictPolicyOverride {
+		return true
+	}
+	return slices.ContainsFunc(spec.EnvironmentConfigs, func(s v1beta1.EnvironmentSource) bool {
+		return ptr.Deref(s.ConflictPolicy, v1beta1.ConflictPolicyOverride) != v1beta1.ConflictPolicyOverride
+	})
 }
 
-func getSelectedEnvConfigs(in *v1beta1.Input, requiredResources map[string][]resource.Required) (map[string][]unstructured.Unstructured, error) {
-	envConfigs := make(map[string][]unstructured.Unstructured)
+// orderLayers returns the layers to be merged by increasing precedence, as
+// specified by the Input, and the patches to be applied afterwards.
+func orderLayers(spec *v1beta1.EnvironmentSpec, inputEnv *unstructured.Unstructured, envConfigs []envLayer) ([]envLayer, []envLayer, error) {
+	byLayer := make(map[v1beta1.PrecedenceLayer][]envLayer, 3)
+	if spec.DefaultData != nil {
+		defaultData, err := unmarshalData(spec.DefaultData)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "cannot unmarshal default data")
+		}
+		byLayer[v1beta1.PrecedenceLayerDefaultData] = []envLayer{{kind: layerKindDefaultData, data: defaultData}}
+	}
+	// In FillMissing mode the environment found in the Context is not merged
+	// as a layer, it is filled with the computed one instead.
+	if inputEnv != nil && spec.GetMergeMode() != v1beta1.MergeModeFillMissing {
+		byLayer[v1beta1.PrecedenceLayerContext] = []envLayer{{kind: layerKindContext, data: inputEnv.Object}}
+	}
+	var patches []envLayer
+	for _, l := range envConfigs {
+		if l.patchType != "" {
+			patches = append(patches, l)
+			continue
+		}
+		byLayer[v1beta1.PrecedenceLayerEnvironmentConfigs] = append(byLayer[v1beta1.PrecedenceLayerEnvironmentConfigs], l)
+	}
 
-	for i, config := range in.Spec.EnvironmentConfigs {
-		extraResName := fmt.Sprintf("environment-config-%d", i)
-		resources, ok := requiredResources[extraResName]
-		if !ok {
-			// Skip if the required resource was not requested (e.g., optional selector with no matchLabels)
+	precedence := spec.GetPrecedence()
+	layers := make([]envLayer, 0, len(envConfigs)+2)
+	for i, p := range precedence {
+		if slices.Contains(precedence[:i], p) {
+			return nil, nil, errors.Errorf("layer %q listed more than once in precedence", p)
+		}
+		layers = append(layers, byLayer[p]...)
+	}
+	return layers, patches, nil
+}
+
+// getListMerges returns the list merge configurations of the Input, by field
+// path.
+func getListMerges(spec *v1beta1.EnvironmentSpec) (map[string]v1beta1.ListMerge, error) {
+	out := make(map[string]v1beta1.ListMerge, len(spec.ListMerges))
+	for _, lm := range spec.ListMerges {
+		if lm.GetBehavior() == v1beta1.ListMergeBehaviorMergeByKey && lm.MergeKey == nil {
+			return nil, errors.Errorf("mergeKey is required for behavior %q of list %q", lm.GetBehavior(), lm.Path)
+		}
+		out[lm.Path] = lm
+	}
+	return out, nil
+}
+
+// classifyConflicts returns the description of the supplied conflicts to be
+// reported as warnings and as errors, according to the conflict policy of the
+// source of the overriding value.
+func classifyConflicts(spec *v1beta1.EnvironmentSpec, conflicts []conflict) (warnings, errs []string) {
+	sorted := slices.Clone(conflicts)
+	slices.SortStableFunc(sorted, func(a, b conflict) int {
+		return cmp.Compare(a.path, b.path)
+	})
+	for _, c := range sorted {
+		policy := spec.ConflictPolicy
+		if c.origin.source < len(spec.EnvironmentConfigs) && spec.EnvironmentConfigs[c.origin.source].ConflictPolicy != nil {
+			policy = spec.EnvironmentConfigs[c.origin.source].ConflictPolicy
+		}
+		switch ptr.Deref(policy, v1beta1.ConflictPolicyOverride) {
+		case v1beta1.ConflictPolicyWarn:
+			warnings = append(warnings, c.String())
+		case v1beta1.ConflictPolicyError:
+			errs = append(errs, c.String())
+		case v1beta1.ConflictPolicyOverride:
+		}
+	}
+	return warnings, errs
+}
+
+// filterTypeChanges returns the description of the supplied type changes not
+// exempted by the type check, sorted by path.
+func filterTypeChanges(tc *v1beta1.TypeCheck, changes []typeChange) []string {
+	out := make([]string, 0, len(changes))
+	for _, c := range changes {
+		if slices.ContainsFunc(tc.ExemptPaths, func(p string) bool { return isPathUnder(c.path, p) }) {
 			continue
 		}
+		out = append(out, c.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+// writeProvenance writes the provenance of the environment to the Context key
+// and to the desired composite resource field path requested.
+func writeProvenance(rsp *fnv1.RunFunctionResponse, dxr *resource.Composite, p *v1beta1.Provenance, provenance map[string]any) error {
+	if key := p.GetContextKey(); key != "" {
+		v, err := structpb.NewStruct(provenance)
+		if err != nil {
+			return errors.Wrap(err, "cannot convert provenance to protobuf Struct well-known type")
+		}
+		response.SetContextKey(rsp, key, structpb.NewStructValue(v))
+	}
+	if p.ToCompositeFieldPath == nil {
+		return nil
+	}
+	return errors.Wrapf(fieldpath.Pave(dxr.Resource.Object).SetValue(*p.ToCompositeFieldPath, provenance), "cannot set provenance at composite resource field path %q", *p.ToCompositeFieldPath)
+}
 
-		toFieldPath := ""
-		if config.ToFieldPath != nil {
-			toFieldPath = *config.ToFieldPath
+// exportFields writes the requested fields of the environment to the desired
+// composite resource.
+func exportFields(dxr *resource.Composite, env map[string]any, exports []v1beta1.Export) error {
+	for _, e := range exports {
+		v, err := fieldpath.Pave(env).GetValue(e.FromFieldPath)
+		if fieldpath.IsNotFound(err) && e.Policy.GetFromFieldPathPolicy() == v1beta1.FromFieldPathPolicyOptional {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "cannot get environment field %q", e.FromFieldPath)
 		}
+		var mo *xpv1.MergeOptions
+		if e.Policy != nil {
+			mo = e.Policy.MergeOptions
+		}
+		if err := fieldpath.Pave(dxr.Resource.Object).MergeValue(e.ToFieldPath, v, mo); err != nil {
+			return errors.Wrapf(err, "cannot set composite resource field %q", e.ToFieldPath)
+		}
+	}
+	return nil
+}
+
+func getSelectedEnvConfigs(env environment, xr *resource.Composite, requiredResources map[string][]resource.Required, opts mergeOptions, dec *decrypter) ([]envLayer, error) {
+	envConfigs := make([]envLayer, 0)
 
-		switch config.GetType() {
-		case v1beta1.EnvironmentSourceTypeReference:
-			out, err := processSourceByReference(in, config, resources)
+	for i, config := range env.spec.EnvironmentConfigs {
+		if config.GetType() == v1beta1.EnvironmentSourceTypeComposite {
+			l, err := compositeLayer(config, xr)
 			if err != nil {
-				return nil, errors.Wrapf(err, "cannot process environment config %q by reference, %q", config.Ref.Name, extraResName)
+				return nil, errors.Wrapf(err, "cannot load composite resource source %d", i)
 			}
-			if out == nil {
-				continue
+			if l != nil {
+				l.source = i
+				envConfigs = append(envConfigs, *l)
 			}
-			envConfigs[toFieldPath] = append(envConfigs[toFieldPath], *out)
+			continue
+		}
 
-		case v1beta1.EnvironmentSourceTypeSelector:
-			out, err := processEnvironmentSource(config, resources)
+		if config.GetType() == v1beta1.EnvironmentSourceTypeIndex {
+			idx, ok := requiredResources[env.requirementName(i)]
+			if !ok {
+				continue
+			}
+			sources, err := getIndexSources(env.spec, config, idx)
 			if err != nil {
-				return nil, errors.Wrapf(err, "cannot process environment config %q by selector", extraResName)
+				return nil, errors.Wrapf(err, "cannot process environment config index %q, %q", config.Ref.Name, env.requirementName(i))
 			}
-			if len(out) > 0 {
-				envConfigs[toFieldPath] = append(envConfigs[toFieldPath], out...)
+			for j, nested := range sources {
+				layers, err := loadSource(env.spec, nested, env.indexRequirementName(i, j), requiredResources, opts, dec)
+				if err != nil {
+					return nil, err
+				}
+				for k := range layers {
+					layers[k].source = i
+				}
+				envConfigs = append(envConfigs, layers...)
 			}
+			continue
+		}
+
+		layers, err := loadSource(env.spec, config, env.requirementName(i), requiredResources, opts, dec)
+		if err != nil {
+			return nil, err
 		}
+		for j := range layers {
+			layers[j].source = i
+		}
+		envConfigs = append(envConfigs, layers...)
 	}
+
+	// EnvironmentConfigs are merged by priority, preserving their relative
+	// order among the ones with the same priority.
+	slices.SortStableFunc(envConfigs, func(a, b envLayer) int {
+		return cmp.Compare(a.priority, b.priority)
+	})
 	return envConfigs, nil
 }
 
+// loadSource returns the layers of the EnvironmentConfigs selected by the
+// supplied source, required as extraResName. Their parents, if any, are merged
+// with the supplied options, once decrypted by the supplied decrypter if any.
+func loadSource(spec *v1beta1.EnvironmentSpec, config v1beta1.EnvironmentSource, extraResName string, requiredResources map[string][]resource.Required, opts mergeOptions, dec *decrypter) ([]envLayer, error) {
+	if config.GetType() == v1beta1.EnvironmentSourceTypeInline {
+		data, err := unmarshalData(config.Data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal inline data of %q", extraResName)
+		}
+		layers, err := buildEnvLayers(config, []unstructured.Unstructured{{Object: map[string]any{"data": data}}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot load inline data of %q", extraResName)
+		}
+		for j := range layers {
+			layers[j].kind = layerKindEnvironmentConfig
+			layers[j].priority = ptr.Deref(config.Priority, 0)
+		}
+		return layers, nil
+	}
+
+	resources, ok := requiredResources[extraResName]
+	if !ok {
+		// Skip if the required resource was not requested (e.g., optional selector with no matchLabels)
+		return nil, nil
+	}
+
+	var selected []unstructured.Unstructured
+	switch config.GetType() {
+	case v1beta1.EnvironmentSourceTypeReference:
+		out, err := processSourceByReference(spec, config, resources)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot process environment config %q by reference, %q", config.Ref.Name, extraResName)
+		}
+		if out == nil {
+			return nil, nil
+		}
+		selected = append(selected, *out)
+
+	case v1beta1.EnvironmentSourceTypeSelector:
+		out, err := processEnvironmentSource(config, resources)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot process environment config %q by selector", extraResName)
+		}
+		selected = append(selected, out...)
+	}
+
+	for j := range selected {
+		resolved, err := resolveExtends(selected[j], requiredResources, opts, dec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot resolve parents of environment configs selected by %q", extraResName)
+		}
+		selected[j] = resolved
+	}
+
+	layers, err := buildEnvLayers(config, selected)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load environment configs selected by %q", extraResName)
+	}
+	for j := range layers {
+		layers[j].kind = layerKindEnvironmentConfig
+	}
+	return layers, nil
+}
+
+// buildEnvLayers returns the layers to be merged into the environment for the
+// EnvironmentConfigs selected by the supplied source, aggregating them if
+// required.
+func buildEnvLayers(config v1beta1.EnvironmentSource, selected []unstructured.Unstructured) ([]envLayer, error) {
+	selected, err := decodeFields(config.Decode, selected)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]envLayer, 0, len(selected))
+	for _, c := range selected {
+		priority, err := getPriority(c, config.PriorityFieldPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get priority of environment config %q", c.GetName())
+		}
+		layers = append(layers, envLayer{
+			name:        c.GetName(),
+			data:        c.Object["data"],
+			toFieldPath: ptr.Deref(config.ToFieldPath, ""),
+			priority:    priority,
+		})
+	}
+	if config.PatchType != nil {
+		return patchLayers(config, selected, layers)
+	}
+	fields, err := aggregateFields(config, selected, layers)
+	if err != nil {
+		return nil, err
+	}
+	if config.GetAggregation() != v1beta1.EnvironmentSourceAggregationMerge {
+		aggregated, err := aggregateEnvLayers(config, selected, layers)
+		if err != nil {
+			return nil, err
+		}
+		layers = []envLayer{aggregated}
+	}
+	layers = append(layers, fields...)
+	if config.IncludeMetadata != nil && len(selected) > 0 {
+		layers = append(layers, metadataLayer(config, selected, layers))
+	}
+	return layers, nil
+}
+
+// metadataLayer returns a layer holding the requested metadata of the
+// selected EnvironmentConfigs, as a list in Multiple mode or as an object
+// otherwise. The layer has the highest priority among the supplied ones.
+func metadataLayer(config v1beta1.EnvironmentSource, selected []unstructured.Unstructured, layers []envLayer) envLayer {
+	out := envLayer{toFieldPath: config.IncludeMetadata.ToFieldPath}
+	out.name, out.priority = summarizeLayers(layers)
+
+	metas := make([]any, 0, len(selected))
+	for _, c := range selected {
+		meta := map[string]any{}
+		for _, f := range config.IncludeMetadata.GetFields() {
+			v, ok, _ := unstructured.NestedFieldCopy(c.Object, "metadata", string(f))
+			if ok {
+				meta[string(f)] = v
+			}
+		}
+		metas = append(metas, meta)
+	}
+	out.data = metas[0]
+	if config.Type == v1beta1.EnvironmentSourceTypeSelector && config.Selector.GetMode() == v1beta1.EnvironmentSourceSelectorMultiMode {
+		out.data = metas
+	}
+	return out
+}
+
+// aggregateFields returns a layer for each of the source's field aggregations,
+// reducing the values of a field across all the selected EnvironmentConfigs.
+// The resulting layers have the highest priority among the supplied ones.
+func aggregateFields(config v1beta1.EnvironmentSource, selected []unstructured.Unstructured, layers []envLayer) ([]envLayer, error) {
+	if len(config.Aggregate) == 0 {
+		return nil, nil
+	}
+	name, priority := summarizeLayers(layers)
+	out := make([]envLayer, 0, len(config.Aggregate))
+	for _, agg := range config.Aggregate {
+		if agg.FromFieldPath == "" && agg.Operation != v1beta1.AggregateOperationCount {
+			return nil, errors.Errorf("fromFieldPath is required for aggregate operation %q", agg.Operation)
+		}
+		values := make([]any, 0, len(selected))
+		for _, c := range selected {
+			if agg.FromFieldPath == "" {
+				values = append(values, c.Object)
+				continue
+			}
+			v, err := fieldpath.Pave(c.Object).GetValue(agg.FromFieldPath)
+			if fieldpath.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot get value at %q from environment config %q", agg.FromFieldPath, c.GetName())
+			}
+			values = append(values, v)
+		}
+		v, ok, err := reduceValues(agg.Operation, values)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot aggregate values at %q with operation %q", agg.FromFieldPath, agg.Operation)
+		}
+		if !ok {
+			continue
+		}
+		out = append(out, envLayer{
+			name:        name,
+			data:        v,
+			toFieldPath: agg.ToFieldPath,
+			priority:    priority,
+		})
+	}
+	return out, nil
+}
+
+// reduceValues reduces the supplied values according to the operation. It
+// returns false if the operation has no result, e.g. the max of no values.
+func reduceValues(op v1beta1.AggregateOperation, values []any) (any, bool, error) { //nolint:gocyclo // just a switch over the supported operations
+	switch op {
+	case v1beta1.AggregateOperationCount:
+		return int64(len(values)), true, nil
+	case v1beta1.AggregateOperationConcat, v1beta1.AggregateOperationUnique:
+		out := make([]any, 0, len(values))
+		for _, v := range values {
+			if l, ok := v.([]any); ok {
+				out = append(out, l...)
+				continue
+			}
+			out = append(out, v)
+		}
+		if op == v1beta1.AggregateOperationUnique {
+			unique := make([]any, 0, len(out))
+			for _, v := range out {
+				if !slices.ContainsFunc(unique, func(u any) bool { return reflect.DeepEqual(u, v) }) {
+					unique = append(unique, v)
+				}
+			}
+			out = unique
+		}
+		return out, true, nil
+	case v1beta1.AggregateOperationSum:
+		var isum int64
+		var fsum float64
+		isFloat := false
+		for _, v := range values {
+			switch n := v.(type) {
+			case int64:
+				isum += n
+				fsum += float64(n)
+			case float64:
+				fsum += n
+				isFloat = true
+			default:
+				return nil, false, errors.Errorf("cannot sum value of type %T", v)
+			}
+		}
+		if isFloat {
+			return fsum, true, nil
+		}
+		return isum, true, nil
+	case v1beta1.AggregateOperationMin, v1beta1.AggregateOperationMax:
+		if len(values) == 0 {
+			return nil, false, nil
+		}
+		out := values[0]
+		for _, v := range values[1:] {
+			c, err := compareValues(v, out)
+			if err != nil {
+				return nil, false, err
+			}
+			if (op == v1beta1.AggregateOperationMin && c < 0) || (op == v1beta1.AggregateOperationMax && c > 0) {
+				out = v
+			}
+		}
+		return out, true, nil
+	default:
+		// should never happen
+		return nil, false, errors.Errorf("unknown aggregate operation %q", op)
+	}
+}
+
+// compareValues compares two numbers or two strings.
+func compareValues(a, b any) (int, error) {
+	if as, ok := a.(string); ok {
+		bs, ok := b.(string)
+		if !ok {
+			return 0, errors.Errorf("cannot compare values of different types %T and %T", a, b)
+		}
+		return cmp.Compare(as, bs), nil
+	}
+	af, aok := toFloat64(a)
+	bf, bok := toFloat64(b)
+	if !aok || !bok {
+		return 0, errors.Errorf("cannot compare values of types %T and %T", a, b)
+	}
+	return cmp.Compare(af, bf), nil
+}
+
+// toFloat64 converts a JSON number to float64.
+func toFloat64(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// patchLayers turns the supplied layers into patch layers, holding the patch
+// found in the data of the selected EnvironmentConfigs.
+func patchLayers(config v1beta1.EnvironmentSource, selected []unstructured.Unstructured, layers []envLayer) ([]envLayer, error) {
+	if config.ToFieldPath != nil {
+		return nil, errors.Errorf("toFieldPath is not supported for patch type %q", *config.PatchType)
+	}
+	for i := range layers {
+		p, ok, err := unstructured.NestedFieldNoCopy(selected[i].Object, "data", "patch")
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get patch of environment config %q", layers[i].name)
+		}
+		if !ok {
+			return nil, errors.Errorf("environment config %q has no patch at data.patch", layers[i].name)
+		}
+		layers[i].data = p
+		layers[i].patchType = *config.PatchType
+	}
+	return layers, nil
+}
+
+// summarizeLayers returns the names of the supplied layers and the highest
+// priority among them, to be used by a layer derived from all of them.
+func summarizeLayers(layers []envLayer) (string, int64) {
+	var priority int64
+	names := make([]string, 0, len(layers))
+	for i, l := range layers {
+		names = append(names, l.name)
+		if i == 0 || l.priority > priority {
+			priority = l.priority
+		}
+	}
+	return strings.Join(names, ","), priority
+}
+
+// aggregateEnvLayers collects the data of the supplied layers into a single
+// one, as a list or as a map according to the source's aggregation. The
+// resulting layer has the highest priority among the aggregated ones.
+func aggregateEnvLayers(config v1beta1.EnvironmentSource, selected []unstructured.Unstructured, layers []envLayer) (envLayer, error) {
+	out := envLayer{toFieldPath: ptr.Deref(config.ToFieldPath, "")}
+	out.name, out.priority = summarizeLayers(layers)
+
+	switch a := config.GetAggregation(); a {
+	case v1beta1.EnvironmentSourceAggregationList:
+		if out.toFieldPath == "" {
+			return envLayer{}, errors.Errorf("toFieldPath is required for aggregation %q", a)
+		}
+		list := make([]any, 0, len(layers))
+		for _, l := range layers {
+			list = append(list, l.data)
+		}
+		out.data = list
+	case v1beta1.EnvironmentSourceAggregationMapByName, v1beta1.EnvironmentSourceAggregationMapByFieldPath:
+		m := make(map[string]any, len(layers))
+		for i, l := range layers {
+			key := l.name
+			if a == v1beta1.EnvironmentSourceAggregationMapByFieldPath {
+				if config.AggregationKeyFieldPath == nil {
+					return envLayer{}, errors.Errorf("aggregationKeyFieldPath is required for aggregation %q", a)
+				}
+				k, err := fieldpath.Pave(selected[i].Object).GetString(*config.AggregationKeyFieldPath)
+				if err != nil {
+					return envLayer{}, errors.Wrapf(err, "cannot get aggregation key of environment config %q", l.name)
+				}
+				key = k
+			}
+			if _, ok := m[key]; ok {
+				return envLayer{}, errors.Errorf("duplicate aggregation key %q for environment config %q", key, l.name)
+			}
+			m[key] = l.data
+		}
+		out.data = m
+	default:
+		// should never happen
+		return envLayer{}, errors.Errorf("unknown aggregation %q", a)
+	}
+	return out, nil
+}
+
+// getPriority returns the priority of an EnvironmentConfig, read from the
+// supplied field path if any, or from the priority annotation otherwise.
+// EnvironmentConfigs not declaring a priority have priority 0.
+func getPriority(c unstructured.Unstructured, path *string) (int64, error) {
+	if path == nil {
+		v, ok := c.GetAnnotations()[AnnotationKeyPriority]
+		if !ok {
+			return 0, nil
+		}
+		p, err := strconv.ParseInt(v, 10, 64)
+		return p, errors.Wrapf(err, "cannot parse annotation %q as integer", AnnotationKeyPriority)
+	}
+
+	v, err := fieldpath.Pave(c.Object).GetValue(*path)
+	if fieldpath.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch p := v.(type) {
+	case int64:
+		return p, nil
+	case float64:
+		if p != math.Trunc(p) {
+			return 0, errors.Errorf("priority at %q is not an integer: %v", *path, p)
+		}
+		return int64(p), nil
+	case string:
+		i, err := strconv.ParseInt(p, 10, 64)
+		return i, errors.Wrapf(err, "cannot parse priority at %q as integer", *path)
+	default:
+		return 0, errors.Errorf("unsupported type %T for priority at %q", v, *path)
+	}
+}
+
 func processEnvironmentSource(config v1beta1.EnvironmentSource, resources []resource.Required) ([]unstructured.Unstructured, error) {
 	out := make([]unstructured.Unstructured, 0)
 	selector := config.Selector
@@ -204,10 +1059,10 @@ func processEnvironmentSource(config v1beta1.EnvironmentSource, resources []reso
 	return out, nil
 }
 
-func processSourceByReference(in *v1beta1.Input, config v1beta1.EnvironmentSource, resources []resource.Required) (*unstructured.Unstructured, error) {
+func processSourceByReference(spec *v1beta1.EnvironmentSpec, config v1beta1.EnvironmentSource, resources []resource.Required) (*unstructured.Unstructured, error) {
 	envConfigName := config.Ref.Name
 	if len(resources) == 0 {
-		if in.Spec.Policy.IsResolutionPolicyOptional() {
+		if spec.Policy.IsResolutionPolicyOptional() {
 			return nil, nil
 		}
 		return nil, errors.Errorf("Required environment config %q not found", envConfigName)
@@ -314,90 +1169,148 @@ func lessAs[T cmp.Ordered](a, b any) (bool, error) {
 	return cmp.Less(av, bv), nil
 }
 
-func buildRequirements(in *v1beta1.Input, xr *resource.Composite) (*fnv1.Requirements, error) {
-	resources := make(map[string]*fnv1.ResourceSelector, len(in.Spec.EnvironmentConfigs))
-	for i, config := range in.Spec.EnvironmentConfigs {
-		extraResName := fmt.Sprintf("environment-config-%d", i)
-		switch config.Type {
-		case v1beta1.EnvironmentSourceTypeReference, "":
-			resources[extraResName] = &fnv1.ResourceSelector{
-				ApiVersion: "apiextensions.crossplane.io/v1beta1",
-				Kind:       "EnvironmentConfig",
-				Match: &fnv1.ResourceSelector_MatchName{
-					MatchName: config.Ref.Name,
-				},
-			}
-		case v1beta1.EnvironmentSourceTypeSelector:
-			matchLabels := map[string]string{}
-			for _, selector := range config.Selector.MatchLabels {
-				switch selector.GetType() {
-				case v1beta1.EnvironmentSourceSelectorLabelMatcherTypeValue:
-					// TODO validate value not to be nil
-					matchLabels[selector.Key] = *selector.Value
-				case v1beta1.EnvironmentSourceSelectorLabelMatcherTypeFromCompositeFieldPath:
-					value, err := fieldpath.Pave(xr.Resource.Object).GetString(*selector.ValueFromFieldPath)
-					if err != nil {
-						if !selector.FromFieldPathIsOptional() {
-							return nil, errors.Wrapf(err, "cannot get value from field path %q", *selector.ValueFromFieldPath)
-						}
-						continue
-					}
-					matchLabels[selector.Key] = value
-				}
-			}
-			if len(matchLabels) == 0 {
-				continue
-			}
-			resources[extraResName] = &fnv1.ResourceSelector{
-				ApiVersion: "apiextensions.crossplane.io/v1beta1",
-				Kind:       "EnvironmentConfig",
-				Match: &fnv1.ResourceSelector_MatchLabels{
-					MatchLabels: &fnv1.MatchLabels{Labels: matchLabels},
-				},
-			}
+func buildRequirements(envs []environment, xr *resource.Composite, requiredResources map[string][]resource.Required) (*fnv1.Requirements, error) {
+	resources := make(map[string]*fnv1.ResourceSelector)
+	for _, env := range envs {
+		if err := addRequirements(resources, env, xr, requiredResources); err != nil {
+			return nil, err
 		}
 	}
+	addExtendsRequirements(resources, requiredResources)
 	return &fnv1.Requirements{Resources: resources}, nil
 }
 
-func mergeEnvConfigsData(configsByField map[string][]unstructured.Unstructured) (map[string]any, error) {
-	merged := map[string]any{}
-	for fieldPath, configs := range configsByField {
-		for _, c := range configs {
-			data := map[string]any{}
-			if fieldPath != "" {
-				if err := fieldpath.Pave(data).SetValue(fieldPath, c.Object["data"]); err != nil {
-					return nil, errors.Errorf("cannot get data from environment config %s into path %q", c.GetName(), fieldPath)
-				}
-			} else {
-				if err := fieldpath.Pave(c.Object).GetValueInto("data", &data); err != nil {
-					return nil, errors.Wrapf(err, "cannot get data from environment config %q", c.GetName())
-				}
+// addRequirements adds the requirements of the sources of the supplied
+// environment to resources.
+func addRequirements(resources map[string]*fnv1.ResourceSelector, env environment, xr *resource.Composite, requiredResources map[string][]resource.Required) error {
+	if s := env.spec.Schema; s != nil && s.Inline == nil && s.Ref != nil {
+		resources[env.schemaRequirementName()] = &fnv1.ResourceSelector{
+			ApiVersion: "apiextensions.crossplane.io/v1beta1",
+			Kind:       "EnvironmentConfig",
+			Match: &fnv1.ResourceSelector_MatchName{
+				MatchName: s.Ref.Name,
+			},
+		}
+	}
+	for i, config := range env.spec.EnvironmentConfigs {
+		if err := addSourceRequirement(resources, env.requirementName(i), config, xr); err != nil {
+			return err
+		}
+		if config.GetType() != v1beta1.EnvironmentSourceTypeIndex {
+			continue
+		}
+		// The sources listed by an index are only known once it's required.
+		idx, ok := requiredResources[env.requirementName(i)]
+		if !ok {
+			continue
+		}
+		sources, err := getIndexSources(env.spec, config, idx)
+		if err != nil {
+			return errors.Wrapf(err, "cannot process environment config index %q, %q", config.Ref.Name, env.requirementName(i))
+		}
+		for j, nested := range sources {
+			if err := addSourceRequirement(resources, env.indexRequirementName(i, j), nested, xr); err != nil {
+				return err
 			}
-
-			merged = mergeMaps(merged, data)
 		}
 	}
-	return merged, nil
+	return nil
 }
 
-func mergeMaps(a, b map[string]any) map[string]any {
-	out := make(map[string]any, len(a))
-	maps.Copy(out, a)
-	for k, v := range b {
-		if v, ok := v.(map[string]any); ok {
-			if bv, ok := out[k]; ok {
-				if bv, ok := bv.(map[string]any); ok {
-					out[k] = mergeMaps(bv, v)
+// addSourceRequirement adds the requirement of the supplied source to
+// resources, as extraResName.
+func addSourceRequirement(resources map[string]*fnv1.ResourceSelector, extraResName string, config v1beta1.EnvironmentSource, xr *resource.Composite) error {
+	switch config.GetType() {
+	case v1beta1.EnvironmentSourceTypeReference, v1beta1.EnvironmentSourceTypeIndex:
+		resources[extraResName] = &fnv1.ResourceSelector{
+			ApiVersion: "apiextensions.crossplane.io/v1beta1",
+			Kind:       "EnvironmentConfig",
+			Match: &fnv1.ResourceSelector_MatchName{
+				MatchName: config.Ref.Name,
+			},
+		}
+	case v1beta1.EnvironmentSourceTypeSelector:
+		matchLabels := map[string]string{}
+		for _, selector := range config.Selector.MatchLabels {
+			switch selector.GetType() {
+			case v1beta1.EnvironmentSourceSelectorLabelMatcherTypeValue:
+				// TODO validate value not to be nil
+				matchLabels[selector.Key] = *selector.Value
+			case v1beta1.EnvironmentSourceSelectorLabelMatcherTypeFromCompositeFieldPath:
+				value, err := fieldpath.Pave(xr.Resource.Object).GetString(*selector.ValueFromFieldPath)
+				if err != nil {
+					if !selector.FromFieldPathIsOptional() {
+						return errors.Wrapf(err, "cannot get value from field path %q", *selector.ValueFromFieldPath)
+					}
 					continue
 				}
+				matchLabels[selector.Key] = value
 			}
 		}
-		out[k] = v
+		if len(matchLabels) == 0 {
+			return nil
+		}
+		resources[extraResName] = &fnv1.ResourceSelector{
+			ApiVersion: "apiextensions.crossplane.io/v1beta1",
+			Kind:       "EnvironmentConfig",
+			Match: &fnv1.ResourceSelector_MatchLabels{
+				MatchLabels: &fnv1.MatchLabels{Labels: matchLabels},
+			},
+		}
+	}
+	return nil
+}
+
+// environmentData returns the data of the supplied environment, i.e. without
+// its apiVersion and kind.
+func environmentData(env map[string]any) map[string]any {
+	out := make(map[string]any, len(env))
+	for k, v := range env {
+		if k != "apiVersion" && k != "kind" {
+			out[k] = v
+		}
 	}
 	return out
 }
 
+// mergeEnvConfigsData merges the data of the supplied layers in order, each
+// loaded at its toFieldPath, so that later layers win over earlier ones. The
+// SOPS encrypted data of EnvironmentConfigs is decrypted, if a decrypter is
+// supplied, reporting the failures of all EnvironmentConfigs at once.
+func mergeEnvConfigsData(m *merger, dec *decrypter, layers []envLayer) (map[string]any, error) {
+	merged := map[string]any{}
+	var decryptErrs []string
+	for _, l := range layers {
+		if dec != nil && l.kind == layerKindEnvironmentConfig {
+			d, err := dec.decrypt(l.data, l.toFieldPath)
+			if err != nil {
+				decryptErrs = append(decryptErrs, fmt.Sprintf("environment config %q: %s", l.name, err))
+				continue
+			}
+			l.data = d
+		}
+
+		data := map[string]any{}
+		if l.toFieldPath != "" {
+			if err := fieldpath.Pave(data).SetValue(l.toFieldPath, l.data); err != nil {
+				return nil, errors.Errorf("cannot get data from environment config %s into path %q", l.name, l.toFieldPath)
+			}
+		} else {
+			d, ok := l.data.(map[string]any)
+			if !ok {
+				return nil, errors.Errorf("cannot get data from environment config %q: expected an object, got %T", l.name, l.data)
+			}
+			data = d
+		}
+
+		merged = m.merge(merged, data, originOf(l))
+	}
+	if len(decryptErrs) > 0 {
+		return nil, errors.Errorf("cannot decrypt %s", strings.Join(decryptErrs, "; "))
+	}
+	return merged, nil
+}
+
 func unmarshalData(data map[string]extv1.JSON) (map[string]any, error) {
 	res := map[string]any{}
 	raw, err := json.Marshal(data)
@@ -409,3 +1322,16 @@ func unmarshalData(data map[string]extv1.JSON) (map[string]any, error) {
 	}
 	return res, nil
 }
+
+// pendingRequirements returns the names of the supplied requirements not yet
+// satisfied by the required resources.
+func pendingRequirements(requirements *fnv1.Requirements, requiredResources map[string][]resource.Required) []string {
+	var out []string
+	for name := range requirements.GetResources() {
+		if _, ok := requiredResources[name]; !ok {
+			out = append(out, name)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
@@ -11,12 +11,15 @@ import (
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/structpb"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/utils/ptr"
 
 	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
 	"github.com/crossplane/function-sdk-go/resource"
 	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
 )
 
 func TestRunFunction(t *testing.T) {
@@ -26,7 +29,9 @@ func TestRunFunction(t *testing.T) {
 	}
 	type want struct {
 		rsp *fnv1.RunFunctionResponse
-		err error
+		// messages of the results, only compared if set.
+		messages []string
+		err      error
 	}
 
 	cases := map[string]struct {
@@ -903,200 +908,2906 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
-	}
-
-	for name, tc := range cases {
-		t.Run(name, func(t *testing.T) {
-			f := &Function{log: logging.NewNopLogger()}
-			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
-
-			diff := cmp.Diff(tc.want.rsp, rsp, cmpopts.AcyclicTransformer("toJsonWithoutResultMessages", func(r *fnv1.RunFunctionResponse) []byte {
-				// We don't care about messages.
-				// cmptopts.IgnoreField wasn't working with protocmp.Transform
-				// We can't split this to another transformer as
-				// transformers are applied not in order but as soon as they
-				// match the type, which are walked from the root (RunFunctionResponse).
-				for _, result := range r.GetResults() {
-					result.Message = ""
-				}
-				out, err := protojson.Marshal(r)
-				if err != nil {
-					t.Fatalf("cannot marshal %T to JSON: %s", r, err)
-				}
-				return out
-			}))
-			if diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
-			}
-
-			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
-			}
-		})
-	}
-}
-
-func resourceWithFieldPathValue(path string, value any) resource.Required {
-	u := unstructured.Unstructured{
-		Object: map[string]any{},
-	}
-	err := fieldpath.Pave(u.Object).SetValue(path, value)
-	if err != nil {
-		panic(err)
-	}
-	return resource.Required{
-		Resource: &u,
-	}
-}
-
-func TestSortRequiredByFieldPath(t *testing.T) {
-	type args struct {
-		requiredResources []resource.Required
-		path              string
-	}
-	type want struct {
-		requiredResources []resource.Required
-		err               error
-	}
-
-	cases := map[string]struct {
-		reason string
-		args   args
-		want   want
-	}{
-		"SortByString": {
-			reason: "The Function should sort the required resources by the string value at the specified field path",
+		"MergeEnvironmentConfigsByPriority": {
+			reason: "The Function should merge EnvironmentConfigs by ascending priority, read from the annotation or from the configured field path",
 			args: args{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("metadata.name", "c"),
-					resourceWithFieldPathValue("metadata.name", "a"),
-					resourceWithFieldPathValue("metadata.name", "b"),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "override"
+									}
+								},
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "base"
+									}
+								},
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "top"
+									},
+									"priorityFieldPath": "data.priority"
+								}
+							]
+						}
+					}`),
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "override",
+										"annotations": {
+											"environmentconfigs.fn.crossplane.io/priority": "10"
+										}
+									},
+									"data": {
+										"a": "from-override",
+										"b": "from-override"
+									}
+								}`),
+								},
+							},
+						},
+						"environment-config-1": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "base"
+									},
+									"data": {
+										"a": "from-base",
+										"b": "from-base",
+										"c": "from-base"
+									}
+								}`),
+								},
+							},
+						},
+						"environment-config-2": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "top",
+										"annotations": {
+											"environmentconfigs.fn.crossplane.io/priority": "-1"
+										}
+									},
+									"data": {
+										"priority": 20,
+										"b": "from-top"
+									}
+								}`),
+								},
+							},
+						},
+					},
 				},
-				path: "metadata.name",
 			},
 			want: want{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("metadata.name", "a"),
-					resourceWithFieldPathValue("metadata.name", "b"),
-					resourceWithFieldPathValue("metadata.name", "c"),
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "override",
+								},
+							},
+							"environment-config-1": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "base",
+								},
+							},
+							"environment-config-2": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "top",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"priority": 20,
+								"a": "from-override",
+								"b": "from-top",
+								"c": "from-base"
+							}`)),
+						},
+					},
 				},
 			},
 		},
-		"SortByInt": {
-			reason: "The Function should sort the required resources by the int value at the specified field path",
+		"Provenance": {
+			reason: "The Function should write the provenance of the environment to the requested Context key and composite resource field path",
 			args: args{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("data.someInt", 3),
-					resourceWithFieldPathValue("data.someInt", 1),
-					resourceWithFieldPathValue("data.someInt", 2),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"defaultData": {
+								"a": "from-default"
+							},
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							],
+							"provenance": {
+								"contextKey": "example.org/provenance",
+								"toCompositeFieldPath": "status.provenance"
+							}
+						}
+					}`),
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"b": "from-foo"
+									}
+								}`),
+								},
+							},
+						},
+					},
 				},
-				path: "data.someInt",
 			},
 			want: want{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("data.someInt", 1),
-					resourceWithFieldPathValue("data.someInt", 2),
-					resourceWithFieldPathValue("data.someInt", 3),
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"status": {
+									"provenance": {
+										"a": {"layer": "DefaultData"},
+										"b": {"layer": "EnvironmentConfig", "source": 0, "name": "foo"}
+									}
+								}
+							}`),
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"a": "from-default",
+								"b": "from-foo"
+							}`)),
+							"example.org/provenance": structpb.NewStructValue(resource.MustStructJSON(`{
+								"a": {"layer": "DefaultData"},
+								"b": {"layer": "EnvironmentConfig", "source": 0, "name": "foo"}
+							}`)),
+						},
+					},
 				},
 			},
 		},
-		"SortByFloat": {
+		"TypeCheckError": {
+			reason: "The Function should return fatal if a merge changes the type of a value not exempted by the type check",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"defaultData": {
+								"network": {
+									"cidr": "10.0.0.0/16"
+								},
+								"labels": {
+									"team": "a"
+								}
+							},
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							],
+							"typeCheck": {
+								"exemptPaths": ["labels"]
+							}
+						}
+					}`),
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"network": "default",
+										"labels": {
+											"team": ["a", "b"]
+										}
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Target:   ptr.To(fnv1.Target_TARGET_COMPOSITE),
+						},
+					},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		"NamedEnvironments": {
+			reason: "The Function should compute each named environment from its own sources and write it to its own Context key",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							],
+							"environments": [
+								{
+									"name": "network",
+									"contextKey": "example.org/network",
+									"defaultData": {
+										"cidr": "10.0.0.0/16"
+									},
+									"environmentConfigs": [
+										{
+											"type": "Reference",
+											"ref": {
+												"name": "bar"
+											}
+										}
+									]
+								}
+							]
+						}
+					}`),
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							"example.org/network": structpb.NewStructValue(resource.MustStructJSON(`{
+								"vpc": "from-context"
+							}`)),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"a": "from-foo"
+									}
+								}`),
+								},
+							},
+						},
+						"environment-network-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "bar"
+									},
+									"data": {
+										"region": "from-bar"
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+							"environment-network-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "bar",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"a": "from-foo"
+							}`)),
+							"example.org/network": structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"cidr": "10.0.0.0/16",
+								"vpc": "from-context",
+								"region": "from-bar"
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"NamedEnvironmentsDuplicateContextKey": {
+			reason: "The Function should return a fatal result if more than one environment is written to the same Context key",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [],
+							"environments": [
+								{
+									"name": "network",
+									"contextKey": "apiextensions.crossplane.io/environment"
+								}
+							]
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  `invalid environments: context key "apiextensions.crossplane.io/environment" used by more than one environment`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"Exports": {
+			reason: "The Function should write the exported fields of the environment to the desired composite resource, skipping optional ones not found",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							],
+							"exports": [
+								{
+									"fromFieldPath": "network.region",
+									"toFieldPath": "status.environment.region"
+								},
+								{
+									"fromFieldPath": "versions",
+									"toFieldPath": "status.environment.versions"
+								},
+								{
+									"fromFieldPath": "account",
+									"toFieldPath": "status.environment.account"
+								}
+							]
+						}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"status": {
+									"ready": true
+								}
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"network": {
+											"region": "eu-west-1"
+										},
+										"versions": {
+											"foo": "1"
+										}
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"status": {
+									"ready": true,
+									"environment": {
+										"region": "eu-west-1",
+										"versions": {
+											"foo": "1"
+										}
+									}
+								}
+							}`),
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"network": {
+									"region": "eu-west-1"
+								},
+								"versions": {
+									"foo": "1"
+								}
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"SchemaViolationsWarn": {
+			reason: "The Function should emit a warning and still write the environment if it does not match a schema with the Warn policy",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							],
+							"schema": {
+								"ref": {
+									"name": "schemas"
+								},
+								"policy": "Warn"
+							}
+						}
+					}`),
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"regoin": "eu-west-1"
+									}
+								}`),
+								},
+							},
+						},
+						"environment-schema": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "schemas"
+									},
+									"data": {
+										"schema": {
+											"type": "object",
+											"required": ["region"]
+										}
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Target:   ptr.To(fnv1.Target_TARGET_COMPOSITE),
+						},
+					},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+							"environment-schema": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "schemas",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"regoin": "eu-west-1"
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"ComputedValues": {
+			reason: "The Function should write the values computed from the merged environment and the observed composite resource",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							],
+							"computed": [
+								{
+									"toFieldPath": "cluster.fullName",
+									"expression": "environment.cluster.name + \"-\" + xr.metadata.name"
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {
+									"name": "example"
+								}
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"cluster": {
+											"name": "prod"
+										}
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"cluster": {
+									"name": "prod",
+									"fullName": "prod-example"
+								}
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"ExtendsPending": {
+			reason: "The Function should require the parent of a selected EnvironmentConfig and exit until it is required",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "prod"
+									}
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "prod",
+										"annotations": {
+											"environmentconfigs.fn.crossplane.io/extends": "base"
+										}
+									},
+									"data": {
+										"replicas": 3
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "prod",
+								},
+							},
+							"environment-config-extends-base": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "base",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		"Extends": {
+			reason: "The Function should merge the parents of a selected EnvironmentConfig before it, parent-first",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "prod"
+									}
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "prod",
+										"annotations": {
+											"environmentconfigs.fn.crossplane.io/extends": "base-prod"
+										}
+									},
+									"data": {
+										"replicas": 3
+									}
+								}`),
+								},
+							},
+						},
+						"environment-config-extends-base-prod": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "base-prod",
+										"annotations": {
+											"environmentconfigs.fn.crossplane.io/extends": "base"
+										}
+									},
+									"data": {
+										"replicas": 2,
+										"tier": "prod"
+									}
+								}`),
+								},
+							},
+						},
+						"environment-config-extends-base": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "base"
+									},
+									"data": {
+										"replicas": 1,
+										"tier": "dev",
+										"region": "eu-west-1"
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "prod",
+								},
+							},
+							"environment-config-extends-base-prod": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "base-prod",
+								},
+							},
+							"environment-config-extends-base": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "base",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"replicas": 3,
+								"tier": "prod",
+								"region": "eu-west-1"
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"Index": {
+			reason: "The Function should require and merge the sources listed by an index in its place",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								},
+								{
+									"type": "Index",
+									"ref": {
+										"name": "platform"
+									}
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"a": "foo",
+										"b": "foo"
+									}
+								}`),
+								},
+							},
+						},
+						"environment-config-1": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "platform"
+									},
+									"data": {
+										"environmentConfigs": [
+											{
+												"type": "Reference",
+												"ref": {
+													"name": "bar"
+												}
+											},
+											{
+												"type": "Selector",
+												"selector": {
+													"matchLabels": [
+														{
+															"key": "layer",
+															"type": "Value",
+															"value": "platform"
+														}
+													]
+												},
+												"toFieldPath": "platform"
+											}
+										]
+									}
+								}`),
+								},
+							},
+						},
+						"environment-config-1-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "bar"
+									},
+									"data": {
+										"b": "bar"
+									}
+								}`),
+								},
+							},
+						},
+						"environment-config-1-1": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "baz",
+										"labels": {
+											"layer": "platform"
+										}
+									},
+									"data": {
+										"c": "baz"
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+							"environment-config-1": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "platform",
+								},
+							},
+							"environment-config-1-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "bar",
+								},
+							},
+							"environment-config-1-1": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchLabels{
+									MatchLabels: &fnv1.MatchLabels{
+										Labels: map[string]string{"layer": "platform"},
+									},
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"a": "foo",
+								"b": "bar",
+								"platform": {
+									"c": "baz"
+								}
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"IndexPending": {
+			reason: "The Function should require the sources listed by an index and exit until they are required",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Index",
+									"ref": {
+										"name": "platform"
+									},
+									"indexFieldPath": "data.layers"
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "platform"
+									},
+									"data": {
+										"layers": [
+											{
+												"ref": {
+													"name": "bar"
+												}
+											}
+										]
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "platform",
+								},
+							},
+							"environment-config-0-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "bar",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		"Inline": {
+			reason: "The Function should merge inline data in the position of its source, among the EnvironmentConfigs of the other sources",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								},
+								{
+									"type": "Inline",
+									"data": {
+										"a": "inline",
+										"b": "inline",
+										"nested": {
+											"c": "inline"
+										}
+									}
+								},
+								{
+									"type": "Inline",
+									"data": {
+										"d": "inline"
+									},
+									"toFieldPath": "nested"
+								},
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "bar"
+									}
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"a": "foo"
+									}
+								}`),
+								},
+							},
+						},
+						"environment-config-3": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "bar"
+									},
+									"data": {
+										"b": "bar"
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+							"environment-config-3": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "bar",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"a": "inline",
+								"b": "bar",
+								"nested": {
+									"c": "inline",
+									"d": "inline"
+								}
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"Composite": {
+			reason: "The Function should merge the subtree of the observed composite resource in the position of its source",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								},
+								{
+									"type": "Composite",
+									"composite": {
+										"fromFieldPath": "spec.parameters.overrides",
+										"allowedKeys": ["replicas"]
+									},
+									"toFieldPath": "workload"
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"spec": {
+									"parameters": {
+										"overrides": {
+											"replicas": 3
+										}
+									}
+								}
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"workload": {
+											"image": "example",
+											"replicas": 1
+										}
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"workload": {
+									"image": "example",
+									"replicas": 3
+								}
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"NamedEnvironmentsDuplicateProvenanceContextKey": {
+			reason: "The Function should return a fatal result if more than one environment writes its provenance to the same Context key",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [],
+							"provenance": {},
+							"environments": [
+								{
+									"name": "network",
+									"contextKey": "example.org/network",
+									"provenance": {}
+								}
+							]
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  `invalid environments: provenance context key "environmentconfigs.fn.crossplane.io/provenance" used by more than one environment`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"SOPSKeyWithoutIdentities": {
+			reason: "The Function should merge objects with a sops key as is if no age identities are configured",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"sops": {
+											"enabled": true
+										}
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"sops": {
+									"enabled": true
+								}
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"InlinePriority": {
+			reason: "The Function should merge inline data with the priority of its source",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Inline",
+									"data": {
+										"a": "inline"
+									},
+									"priority": 10
+								},
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-1": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo",
+										"annotations": {
+											"environmentconfigs.fn.crossplane.io/priority": "5"
+										}
+									},
+									"data": {
+										"a": "foo",
+										"b": "foo"
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-1": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"a": "inline",
+								"b": "foo"
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"InlineOnly": {
+			reason: "The Function should compute the environment of an Input with only inline sources, which requires no resource",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Inline",
+									"data": {
+										"a": "inline",
+										"nested": {
+											"b": "inline"
+										}
+									}
+								},
+								{
+									"type": "Inline",
+									"data": {
+										"c": "inline"
+									},
+									"toFieldPath": "nested"
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results:      []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"a": "inline",
+								"nested": {
+									"b": "inline",
+									"c": "inline"
+								}
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"CompositeAndInline": {
+			reason: "The Function should compute the environment of an Input loading the composite resource over inline defaults, which requires no resource",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Inline",
+									"data": {
+										"image": "example",
+										"replicas": 1
+									}
+								},
+								{
+									"type": "Composite",
+									"composite": {
+										"fromFieldPath": "spec.parameters.overrides",
+										"allowedKeys": ["replicas"]
+									}
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"spec": {
+									"parameters": {
+										"overrides": {
+											"replicas": 3
+										}
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results:      []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"image": "example",
+								"replicas": 3
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"RequiredKeysNotSatisfied": {
+			reason: "The Function should return a single fatal result listing all the required keys not satisfied and the sources consulted",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"defaultData": {
+								"zone": "a"
+							},
+							"environmentConfigs": [
+								{
+									"type": "Reference",
+									"ref": {
+										"name": "foo"
+									}
+								}
+							],
+							"requiredKeys": [
+								{
+									"fieldPath": "zone"
+								},
+								{
+									"fieldPath": "network.vpcId",
+									"type": "String"
+								},
+								{
+									"fieldPath": "network.subnetId"
+								},
+								{
+									"fieldPath": "region",
+									"pattern": "^eu-"
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"environment-config-0": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: resource.MustStructJSON(`{
+									"apiVersion": "apiextensions.crossplane.io/v1beta1",
+									"kind": "EnvironmentConfig",
+									"metadata": {
+										"name": "foo"
+									},
+									"data": {
+										"network": {
+											"vpcId": 5
+										},
+										"region": "us-east-1"
+									}
+								}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Target:   ptr.To(fnv1.Target_TARGET_COMPOSITE),
+						},
+					},
+					Requirements: &fnv1.Requirements{
+						Resources: map[string]*fnv1.ResourceSelector{
+							"environment-config-0": {
+								ApiVersion: "apiextensions.crossplane.io/v1beta1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchName{
+									MatchName: "foo",
+								},
+							},
+						},
+					},
+				},
+				messages: []string{
+					`required environment keys not satisfied: "network.vpcId": expected String, got number; "network.subnetId": missing; "region": string value does not match "^eu-"; consulted sources: default data, environment config "foo" (source 0)`,
+				},
+			},
+		},
+		"FillMissing": {
+			reason: "The Function should only fill the values missing in the Context environment, once patched, never overriding it",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Context: resource.MustStructJSON(`{
+						"` + FunctionContextKeyEnvironment + `": {
+							"apiVersion": "internal.crossplane.io/v1alpha1",
+							"kind": "Environment",
+							"a": "context",
+							"nested": {
+								"b": "context"
+							}
+						}
+					}`),
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"mergeMode": "FillMissing",
+							"defaultData": {
+								"a": "default",
+								"nested": {
+									"b": "default",
+									"c": "default"
+								}
+							},
+							"environmentConfigs": [
+								{
+									"type": "Inline",
+									"data": {
+										"d": "inline"
+									}
+								}
+							],
+							"patches": [
+								{
+									"op": "replace",
+									"path": "/a",
+									"value": "patched"
+								},
+								{
+									"op": "add",
+									"path": "/e",
+									"value": "patched"
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results:      []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"a": "context",
+								"nested": {
+									"b": "context",
+									"c": "default"
+								},
+								"d": "inline",
+								"e": "patched"
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"FillMissingRequiredKeysNotSatisfied": {
+			reason: "The Function should list the Context environment among the sources consulted for required keys in FillMissing mode",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Context: resource.MustStructJSON(`{
+						"` + FunctionContextKeyEnvironment + `": {
+							"apiVersion": "internal.crossplane.io/v1alpha1",
+							"kind": "Environment",
+							"a": "context"
+						}
+					}`),
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"mergeMode": "FillMissing",
+							"defaultData": {
+								"b": "default"
+							},
+							"environmentConfigs": [],
+							"requiredKeys": [
+								{
+									"fieldPath": "a"
+								},
+								{
+									"fieldPath": "c"
+								}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Target:   ptr.To(fnv1.Target_TARGET_COMPOSITE),
+						},
+					},
+					Requirements: &fnv1.Requirements{},
+					Context: resource.MustStructJSON(`{
+						"` + FunctionContextKeyEnvironment + `": {
+							"apiVersion": "internal.crossplane.io/v1alpha1",
+							"kind": "Environment",
+							"a": "context"
+						}
+					}`),
+				},
+				messages: []string{
+					`required environment keys not satisfied: "c": missing; consulted sources: default data, context environment`,
+				},
+			},
+		},
+		"Output": {
+			reason: "The Function should emit the environment as a desired composed resource, keeping the ones desired by previous steps",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [
+								{
+									"type": "Inline",
+									"data": {
+										"network": {
+											"cidr": "10.0.0.0/16"
+										},
+										"region": "eu-west-1"
+									}
+								}
+							],
+							"output": {
+								"kind": "ConfigMap",
+								"name": "example-environment",
+								"namespace": "default"
+							}
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR"
+							}`),
+						},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "example.org/v1",
+									"kind": "Bucket"
+								}`),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results:      []*fnv1.Result{},
+					Requirements: &fnv1.Requirements{},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "example.org/v1",
+									"kind": "Bucket"
+								}`),
+							},
+							"environment": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "v1",
+									"kind": "ConfigMap",
+									"metadata": {
+										"name": "example-environment",
+										"namespace": "default"
+									},
+									"data": {
+										"network.cidr": "10.0.0.0/16",
+										"region": "eu-west-1"
+									}
+								}`),
+								Ready: fnv1.Ready_READY_TRUE,
+							},
+						},
+					},
+					Context: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							FunctionContextKeyEnvironment: structpb.NewStructValue(resource.MustStructJSON(`{
+								"apiVersion": "internal.crossplane.io/v1alpha1",
+								"kind": "Environment",
+								"network": {
+									"cidr": "10.0.0.0/16"
+								},
+								"region": "eu-west-1"
+							}`)),
+						},
+					},
+				},
+			},
+		},
+		"OutputDuplicateResourceName": {
+			reason: "The Function should return a fatal result if more than one environment emits the same desired composed resource",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"spec": {
+							"environmentConfigs": [],
+							"output": {},
+							"environments": [
+								{
+									"name": "network",
+									"contextKey": "example.org/network",
+									"environmentConfigs": [],
+									"output": {
+										"resourceName": "environment"
+									}
+								}
+							]
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Target:   ptr.To(fnv1.Target_TARGET_COMPOSITE),
+						},
+					},
+				},
+				messages: []string{
+					`invalid environments: output resource name "environment" used by more than one environment`,
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if tc.want.messages != nil {
+				messages := make([]string, 0, len(rsp.GetResults()))
+				for _, result := range rsp.GetResults() {
+					messages = append(messages, result.GetMessage())
+				}
+				if diff := cmp.Diff(tc.want.messages, messages); diff != "" {
+					t.Errorf("%s\nf.RunFunction(...): -want messages, +got messages:\n%s", tc.reason, diff)
+				}
+			}
+
+			diff := cmp.Diff(tc.want.rsp, rsp, cmpopts.AcyclicTransformer("toJsonWithoutResultMessages", func(r *fnv1.RunFunctionResponse) []byte {
+				// We don't care about messages.
+				// cmptopts.IgnoreField wasn't working with protocmp.Transform
+				// We can't split this to another transformer as
+				// transformers are applied not in order but as soon as they
+				// match the type, which are walked from the root (RunFunctionResponse).
+				for _, result := range r.GetResults() {
+					result.Message = ""
+				}
+				out, err := protojson.Marshal(r)
+				if err != nil {
+					t.Fatalf("cannot marshal %T to JSON: %s", r, err)
+				}
+				return out
+			}))
+			if diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func resourceWithFieldPathValue(path string, value any) resource.Required {
+	u := unstructured.Unstructured{
+		Object: map[string]any{},
+	}
+	err := fieldpath.Pave(u.Object).SetValue(path, value)
+	if err != nil {
+		panic(err)
+	}
+	return resource.Required{
+		Resource: &u,
+	}
+}
+
+func TestSortRequiredByFieldPath(t *testing.T) {
+	type args struct {
+		requiredResources []resource.Required
+		path              string
+	}
+	type want struct {
+		requiredResources []resource.Required
+		err               error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"SortByString": {
+			reason: "The Function should sort the required resources by the string value at the specified field path",
+			args: args{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("metadata.name", "c"),
+					resourceWithFieldPathValue("metadata.name", "a"),
+					resourceWithFieldPathValue("metadata.name", "b"),
+				},
+				path: "metadata.name",
+			},
+			want: want{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("metadata.name", "a"),
+					resourceWithFieldPathValue("metadata.name", "b"),
+					resourceWithFieldPathValue("metadata.name", "c"),
+				},
+			},
+		},
+		"SortByInt": {
+			reason: "The Function should sort the required resources by the int value at the specified field path",
+			args: args{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("data.someInt", 3),
+					resourceWithFieldPathValue("data.someInt", 1),
+					resourceWithFieldPathValue("data.someInt", 2),
+				},
+				path: "data.someInt",
+			},
+			want: want{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("data.someInt", 1),
+					resourceWithFieldPathValue("data.someInt", 2),
+					resourceWithFieldPathValue("data.someInt", 3),
+				},
+			},
+		},
+		"SortByFloat": {
 			reason: "The Function should sort the required resources by the float value at the specified field path",
 			args: args{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("data.someFloat", 1.3),
-					resourceWithFieldPathValue("data.someFloat", 1.1),
-					resourceWithFieldPathValue("data.someFloat", 1.2),
-					resourceWithFieldPathValue("data.someFloat", 1.4),
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("data.someFloat", 1.3),
+					resourceWithFieldPathValue("data.someFloat", 1.1),
+					resourceWithFieldPathValue("data.someFloat", 1.2),
+					resourceWithFieldPathValue("data.someFloat", 1.4),
+				},
+				path: "data.someFloat",
+			},
+			want: want{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("data.someFloat", 1.1),
+					resourceWithFieldPathValue("data.someFloat", 1.2),
+					resourceWithFieldPathValue("data.someFloat", 1.3),
+					resourceWithFieldPathValue("data.someFloat", 1.4),
+				},
+			},
+		},
+		"InconsistentTypeSortByInt": {
+			reason: "The Function should sort the required resources by the int value at the specified field path",
+			args: args{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("data.someInt", 3),
+					resourceWithFieldPathValue("data.someInt", 1),
+					resourceWithFieldPathValue("data.someInt", "2"),
+				},
+				path: "data.someInt",
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"EmptyPath": {
+			reason: "The Function should return an error if the path is empty",
+			args: args{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("metadata.name", "c"),
+					resourceWithFieldPathValue("metadata.name", "a"),
+					resourceWithFieldPathValue("metadata.name", "b"),
+				},
+				path: "",
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"InvalidPathAll": {
+			reason: "The Function should return no error if the path is invalid for all resources",
+			args: args{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("metadata.name", "c"),
+					resourceWithFieldPathValue("metadata.name", "a"),
+					resourceWithFieldPathValue("metadata.name", "b"),
+				},
+				path: "metadata.invalid",
+			},
+			want: want{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("metadata.name", "c"),
+					resourceWithFieldPathValue("metadata.name", "a"),
+					resourceWithFieldPathValue("metadata.name", "b"),
+				},
+			},
+		},
+		"InvalidPathSome": {
+			reason: "The Function should return no error if the path is invalid for some resources, just use the rest of the resources zero value",
+			args: args{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("metadata.name", "c"),
+					resourceWithFieldPathValue("metadata.invalid", "a"),
+					resourceWithFieldPathValue("metadata.name", "b"),
+				},
+				path: "metadata.name",
+			},
+			want: want{
+				requiredResources: []resource.Required{
+					resourceWithFieldPathValue("metadata.invalid", "a"),
+					resourceWithFieldPathValue("metadata.name", "b"),
+					resourceWithFieldPathValue("metadata.name", "c"),
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := sortRequiredByFieldPath(tc.args.requiredResources, tc.args.path)
+			if diff := cmp.Diff(tc.want.err, got, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\n(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if tc.want.err != nil {
+				return
+			}
+			if diff := cmp.Diff(tc.want.requiredResources, tc.args.requiredResources); diff != "" {
+				t.Errorf("%s\n(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func envConfigWithData(name string, data map[string]any) unstructured.Unstructured {
+	return unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "apiextensions.crossplane.io/v1beta1",
+			"kind":       "EnvironmentConfig",
+			"metadata": map[string]any{
+				"name": name,
+			},
+			"data": data,
+		},
+	}
+}
+
+func TestBuildEnvLayers(t *testing.T) {
+	type args struct {
+		config   v1beta1.EnvironmentSource
+		selected []unstructured.Unstructured
+	}
+	type want struct {
+		layers []envLayer
+		err    error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Merge": {
+			reason: "The Function should return a layer per selected EnvironmentConfig by default",
+			args: args{
+				config: v1beta1.EnvironmentSource{ToFieldPath: ptr.To("peerings")},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"cidr": "10.0.0.0/16"}),
+					envConfigWithData("b", map[string]any{"cidr": "10.1.0.0/16"}),
 				},
-				path: "data.someFloat",
 			},
 			want: want{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("data.someFloat", 1.1),
-					resourceWithFieldPathValue("data.someFloat", 1.2),
-					resourceWithFieldPathValue("data.someFloat", 1.3),
-					resourceWithFieldPathValue("data.someFloat", 1.4),
+				layers: []envLayer{
+					{name: "a", data: map[string]any{"cidr": "10.0.0.0/16"}, toFieldPath: "peerings"},
+					{name: "b", data: map[string]any{"cidr": "10.1.0.0/16"}, toFieldPath: "peerings"},
 				},
 			},
 		},
-		"InconsistentTypeSortByInt": {
-			reason: "The Function should sort the required resources by the int value at the specified field path",
+		"List": {
+			reason: "The Function should collect the data of the selected EnvironmentConfigs in a list with the highest priority",
 			args: args{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("data.someInt", 3),
-					resourceWithFieldPathValue("data.someInt", 1),
-					resourceWithFieldPathValue("data.someInt", "2"),
+				config: v1beta1.EnvironmentSource{
+					ToFieldPath:       ptr.To("peerings"),
+					Aggregation:       v1beta1.EnvironmentSourceAggregationList,
+					PriorityFieldPath: ptr.To("data.priority"),
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"priority": int64(3)}),
+					envConfigWithData("b", map[string]any{"priority": int64(5)}),
+				},
+			},
+			want: want{
+				layers: []envLayer{
+					{
+						name: "a,b",
+						data: []any{
+							map[string]any{"priority": int64(3)},
+							map[string]any{"priority": int64(5)},
+						},
+						toFieldPath: "peerings",
+						priority:    5,
+					},
+				},
+			},
+		},
+		"ListWithoutToFieldPath": {
+			reason: "The Function should return an error if aggregating as a list without a toFieldPath",
+			args: args{
+				config: v1beta1.EnvironmentSource{Aggregation: v1beta1.EnvironmentSourceAggregationList},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"cidr": "10.0.0.0/16"}),
 				},
-				path: "data.someInt",
 			},
 			want: want{
 				err: cmpopts.AnyError,
 			},
 		},
-		"EmptyPath": {
-			reason: "The Function should return an error if the path is empty",
+		"MapByName": {
+			reason: "The Function should collect the data of the selected EnvironmentConfigs in a map keyed by name",
 			args: args{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("metadata.name", "c"),
-					resourceWithFieldPathValue("metadata.name", "a"),
-					resourceWithFieldPathValue("metadata.name", "b"),
+				config: v1beta1.EnvironmentSource{
+					ToFieldPath: ptr.To("peerings"),
+					Aggregation: v1beta1.EnvironmentSourceAggregationMapByName,
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"cidr": "10.0.0.0/16"}),
+					envConfigWithData("b", map[string]any{"cidr": "10.1.0.0/16"}),
+				},
+			},
+			want: want{
+				layers: []envLayer{
+					{
+						name: "a,b",
+						data: map[string]any{
+							"a": map[string]any{"cidr": "10.0.0.0/16"},
+							"b": map[string]any{"cidr": "10.1.0.0/16"},
+						},
+						toFieldPath: "peerings",
+					},
+				},
+			},
+		},
+		"MapByFieldPath": {
+			reason: "The Function should collect the data of the selected EnvironmentConfigs in a map keyed by the value at the field path",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Aggregation:             v1beta1.EnvironmentSourceAggregationMapByFieldPath,
+					AggregationKeyFieldPath: ptr.To("data.region"),
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"region": "eu-west-1"}),
+					envConfigWithData("b", map[string]any{"region": "us-east-1"}),
+				},
+			},
+			want: want{
+				layers: []envLayer{
+					{
+						name: "a,b",
+						data: map[string]any{
+							"eu-west-1": map[string]any{"region": "eu-west-1"},
+							"us-east-1": map[string]any{"region": "us-east-1"},
+						},
+					},
+				},
+			},
+		},
+		"MapByFieldPathDuplicateKey": {
+			reason: "The Function should return an error if two EnvironmentConfigs have the same aggregation key",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Aggregation:             v1beta1.EnvironmentSourceAggregationMapByFieldPath,
+					AggregationKeyFieldPath: ptr.To("data.region"),
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"region": "eu-west-1"}),
+					envConfigWithData("b", map[string]any{"region": "eu-west-1"}),
 				},
-				path: "",
 			},
 			want: want{
 				err: cmpopts.AnyError,
 			},
 		},
-		"InvalidPathAll": {
-			reason: "The Function should return no error if the path is invalid for all resources",
+		"AggregateFields": {
+			reason: "The Function should return a layer per field aggregation, after the selected EnvironmentConfigs",
 			args: args{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("metadata.name", "c"),
-					resourceWithFieldPathValue("metadata.name", "a"),
-					resourceWithFieldPathValue("metadata.name", "b"),
+				config: v1beta1.EnvironmentSource{
+					Aggregation: v1beta1.EnvironmentSourceAggregationMapByName,
+					ToFieldPath: ptr.To("networks"),
+					Aggregate: []v1beta1.FieldAggregation{
+						{FromFieldPath: "data.allowedCidrs", Operation: v1beta1.AggregateOperationUnique, ToFieldPath: "allowedCidrs"},
+						{FromFieldPath: "data.quota.cpu", Operation: v1beta1.AggregateOperationSum, ToFieldPath: "quota.cpu"},
+						{Operation: v1beta1.AggregateOperationCount, ToFieldPath: "networkCount"},
+					},
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"allowedCidrs": []any{"10.0.0.0/16", "10.1.0.0/16"}, "quota": map[string]any{"cpu": int64(2)}}),
+					envConfigWithData("b", map[string]any{"allowedCidrs": []any{"10.1.0.0/16"}, "quota": map[string]any{"cpu": int64(3)}}),
 				},
-				path: "metadata.invalid",
 			},
 			want: want{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("metadata.name", "c"),
-					resourceWithFieldPathValue("metadata.name", "a"),
-					resourceWithFieldPathValue("metadata.name", "b"),
+				layers: []envLayer{
+					{
+						name: "a,b",
+						data: map[string]any{
+							"a": map[string]any{"allowedCidrs": []any{"10.0.0.0/16", "10.1.0.0/16"}, "quota": map[string]any{"cpu": int64(2)}},
+							"b": map[string]any{"allowedCidrs": []any{"10.1.0.0/16"}, "quota": map[string]any{"cpu": int64(3)}},
+						},
+						toFieldPath: "networks",
+					},
+					{name: "a,b", data: []any{"10.0.0.0/16", "10.1.0.0/16"}, toFieldPath: "allowedCidrs"},
+					{name: "a,b", data: int64(5), toFieldPath: "quota.cpu"},
+					{name: "a,b", data: int64(2), toFieldPath: "networkCount"},
 				},
 			},
 		},
-		"InvalidPathSome": {
-			reason: "The Function should return no error if the path is invalid for some resources, just use the rest of the resources zero value",
+		"IncludeMetadata": {
+			reason: "The Function should return a layer with the requested metadata of the referenced EnvironmentConfig",
 			args: args{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("metadata.name", "c"),
-					resourceWithFieldPathValue("metadata.invalid", "a"),
-					resourceWithFieldPathValue("metadata.name", "b"),
+				config: v1beta1.EnvironmentSource{
+					IncludeMetadata: &v1beta1.IncludeMetadata{
+						ToFieldPath: "_sources.network",
+						Fields:      []v1beta1.MetadataField{v1beta1.MetadataFieldName, v1beta1.MetadataFieldUID, v1beta1.MetadataFieldLabels},
+					},
+				},
+				selected: []unstructured.Unstructured{
+					{Object: map[string]any{
+						"metadata": map[string]any{"name": "a", "uid": "1234", "resourceVersion": "42"},
+						"data":     map[string]any{"cidr": "10.0.0.0/16"},
+					}},
 				},
-				path: "metadata.name",
 			},
 			want: want{
-				requiredResources: []resource.Required{
-					resourceWithFieldPathValue("metadata.invalid", "a"),
-					resourceWithFieldPathValue("metadata.name", "b"),
-					resourceWithFieldPathValue("metadata.name", "c"),
+				layers: []envLayer{
+					{name: "a", data: map[string]any{"cidr": "10.0.0.0/16"}},
+					{name: "a", data: map[string]any{"name": "a", "uid": "1234"}, toFieldPath: "_sources.network"},
+				},
+			},
+		},
+		"IncludeMetadataMultipleMode": {
+			reason: "The Function should return a layer with the list of the metadata of the EnvironmentConfigs selected in Multiple mode",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Type:     v1beta1.EnvironmentSourceTypeSelector,
+					Selector: &v1beta1.EnvironmentSourceSelector{Mode: v1beta1.EnvironmentSourceSelectorMultiMode},
+					IncludeMetadata: &v1beta1.IncludeMetadata{
+						ToFieldPath: "_sources.network",
+						Fields:      []v1beta1.MetadataField{v1beta1.MetadataFieldName},
+					},
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"cidr": "10.0.0.0/16"}),
+				},
+			},
+			want: want{
+				layers: []envLayer{
+					{name: "a", data: map[string]any{"cidr": "10.0.0.0/16"}},
+					{name: "a", data: []any{map[string]any{"name": "a"}}, toFieldPath: "_sources.network"},
+				},
+			},
+		},
+		"Decode": {
+			reason: "The Function should parse the JSON and YAML documents held by the requested string values before building the layers",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Decode: []v1beta1.DecodeField{
+						{FieldPath: "data.settings", Format: v1beta1.DecodeFormatJSON},
+						{FieldPath: "data.nested.values", Format: v1beta1.DecodeFormatYAML},
+						{FieldPath: "data.missing", Format: v1beta1.DecodeFormatJSON},
+					},
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{
+						"settings": `{"a": 1, "b": [true]}`,
+						"nested":   map[string]any{"values": "replicas: 2\nname: foo\n"},
+					}),
+				},
+			},
+			want: want{
+				layers: []envLayer{
+					{name: "a", data: map[string]any{
+						"settings": map[string]any{"a": int64(1), "b": []any{true}},
+						"nested":   map[string]any{"values": map[string]any{"replicas": int64(2), "name": "foo"}},
+					}},
+				},
+			},
+		},
+		"DecodeInvalid": {
+			reason: "The Function should return an error if a value cannot be parsed",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Decode: []v1beta1.DecodeField{{FieldPath: "data.settings", Format: v1beta1.DecodeFormatJSON}},
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"settings": `{"a": `}),
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"DecodeNotString": {
+			reason: "The Function should return an error if a value to be parsed is not a string",
+			args: args{
+				config: v1beta1.EnvironmentSource{
+					Decode: []v1beta1.DecodeField{{FieldPath: "data.settings", Format: v1beta1.DecodeFormatYAML}},
+				},
+				selected: []unstructured.Unstructured{
+					envConfigWithData("a", map[string]any{"settings": map[string]any{"a": "b"}}),
 				},
 			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
 		},
 	}
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			got := sortRequiredByFieldPath(tc.args.requiredResources, tc.args.path)
-			if diff := cmp.Diff(tc.want.err, got, cmpopts.EquateErrors()); diff != "" {
-				t.Errorf("%s\n(...): -want err, +got err:\n%s", tc.reason, diff)
+			got, err := buildEnvLayers(tc.args.config, tc.args.selected)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nbuildEnvLayers(...): -want err, +got err:\n%s", tc.reason, diff)
 			}
-			if tc.want.err != nil {
-				return
+			if diff := cmp.Diff(tc.want.layers, got, cmp.AllowUnexported(envLayer{})); diff != "" {
+				t.Errorf("%s\nbuildEnvLayers(...): -want, +got:\n%s", tc.reason, diff)
 			}
-			if diff := cmp.Diff(tc.want.requiredResources, tc.args.requiredResources); diff != "" {
-				t.Errorf("%s\n(...): -want, +got:\n%s", tc.reason, diff)
+		})
+	}
+}
+
+func TestReduceValues(t *testing.T) {
+	type args struct {
+		op     v1beta1.AggregateOperation
+		values []any
+	}
+	type want struct {
+		v   any
+		ok  bool
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Concat": {
+			reason: "Concat should flatten lists and append scalars",
+			args: args{
+				op:     v1beta1.AggregateOperationConcat,
+				values: []any{[]any{"a", "b"}, "b", []any{"c"}},
+			},
+			want: want{v: []any{"a", "b", "b", "c"}, ok: true},
+		},
+		"Unique": {
+			reason: "Unique should flatten lists and drop duplicates",
+			args: args{
+				op:     v1beta1.AggregateOperationUnique,
+				values: []any{[]any{"a", "b"}, "b", []any{"c", "a"}},
+			},
+			want: want{v: []any{"a", "b", "c"}, ok: true},
+		},
+		"SumInt": {
+			reason: "Sum should return an integer when summing integers",
+			args: args{
+				op:     v1beta1.AggregateOperationSum,
+				values: []any{int64(1), int64(2)},
+			},
+			want: want{v: int64(3), ok: true},
+		},
+		"SumFloat": {
+			reason: "Sum should return a float when summing any float",
+			args: args{
+				op:     v1beta1.AggregateOperationSum,
+				values: []any{int64(1), 0.5},
+			},
+			want: want{v: 1.5, ok: true},
+		},
+		"SumString": {
+			reason: "Sum should return an error for non numeric values",
+			args: args{
+				op:     v1beta1.AggregateOperationSum,
+				values: []any{int64(1), "2"},
+			},
+			want: want{err: cmpopts.AnyError},
+		},
+		"MinNumbers": {
+			reason: "Min should return the lowest number",
+			args: args{
+				op:     v1beta1.AggregateOperationMin,
+				values: []any{int64(3), 1.5, int64(2)},
+			},
+			want: want{v: 1.5, ok: true},
+		},
+		"MaxStrings": {
+			reason: "Max should return the highest string",
+			args: args{
+				op:     v1beta1.AggregateOperationMax,
+				values: []any{"1.27", "1.29", "1.28"},
+			},
+			want: want{v: "1.29", ok: true},
+		},
+		"MaxNoValues": {
+			reason: "Max should have no result without values",
+			args: args{
+				op: v1beta1.AggregateOperationMax,
+			},
+			want: want{},
+		},
+		"MaxMixedTypes": {
+			reason: "Max should return an error comparing strings and numbers",
+			args: args{
+				op:     v1beta1.AggregateOperationMax,
+				values: []any{"1", int64(2)},
+			},
+			want: want{err: cmpopts.AnyError},
+		},
+		"Count": {
+			reason: "Count should count the values",
+			args: args{
+				op:     v1beta1.AggregateOperationCount,
+				values: []any{"a", nil, int64(1)},
+			},
+			want: want{v: int64(3), ok: true},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			v, ok, err := reduceValues(tc.args.op, tc.args.values)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nreduceValues(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.v, v); diff != "" {
+				t.Errorf("%s\nreduceValues(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if ok != tc.want.ok {
+				t.Errorf("%s\nreduceValues(...): want ok %t, got %t", tc.reason, tc.want.ok, ok)
+			}
+		})
+	}
+}
+
+func TestClassifyConflicts(t *testing.T) {
+	foo := origin{kind: layerKindEnvironmentConfig, source: 0, name: "foo"}
+	bar := origin{kind: layerKindEnvironmentConfig, source: 1, name: "bar"}
+
+	type args struct {
+		spec      *v1beta1.EnvironmentSpec
+		conflicts []conflict
+	}
+	type want struct {
+		warnings []string
+		errs     []string
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"DefaultOverride": {
+			reason: "Conflicts should be ignored by default",
+			args: args{
+				spec: &v1beta1.EnvironmentSpec{
+					EnvironmentConfigs: []v1beta1.EnvironmentSource{{}, {}},
+				},
+				conflicts: []conflict{{path: "a", previous: []origin{foo}, origin: bar}},
+			},
+			want: want{},
+		},
+		"InputPolicyOverriddenBySource": {
+			reason: "The policy of the source of the overriding value should take precedence over the Input one",
+			args: args{
+				spec: &v1beta1.EnvironmentSpec{
+					ConflictPolicy: ptr.To(v1beta1.ConflictPolicyWarn),
+					EnvironmentConfigs: []v1beta1.EnvironmentSource{
+						{},
+						{ConflictPolicy: ptr.To(v1beta1.ConflictPolicyError)},
+					},
+				},
+				conflicts: []conflict{
+					{path: "b", previous: []origin{foo}, origin: bar},
+					{path: "a", previous: []origin{bar}, origin: foo},
+				},
+			},
+			want: want{
+				warnings: []string{`"a": environment config "bar" (source 1) overridden by environment config "foo" (source 0)`},
+				errs:     []string{`"b": environment config "foo" (source 0) overridden by environment config "bar" (source 1)`},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			warnings, errs := classifyConflicts(tc.args.spec, tc.args.conflicts)
+			if diff := cmp.Diff(tc.want.warnings, warnings); diff != "" {
+				t.Errorf("%s\nclassifyConflicts(...): -want warnings, +got warnings:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.errs, errs); diff != "" {
+				t.Errorf("%s\nclassifyConflicts(...): -want errs, +got errs:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestOrderLayers(t *testing.T) {
+	envConfig := envLayer{kind: layerKindEnvironmentConfig, name: "foo", data: map[string]any{"a": "from-foo"}}
+	patch := envLayer{kind: layerKindEnvironmentConfig, name: "bar", patchType: v1beta1.PatchTypeMergePatch}
+	inputEnv := &unstructured.Unstructured{Object: map[string]any{"a": "from-context"}}
+
+	type args struct {
+		spec       *v1beta1.EnvironmentSpec
+		inputEnv   *unstructured.Unstructured
+		envConfigs []envLayer
+	}
+	type want struct {
+		layers  []envLayer
+		patches []envLayer
+		err     error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"DefaultPrecedence": {
+			reason: "Layers should be ordered as default data, context and EnvironmentConfigs by default, patches being returned separately",
+			args: args{
+				spec: &v1beta1.EnvironmentSpec{
+					DefaultData: map[string]extv1.JSON{"a": {Raw: []byte(`"from-default"`)}},
+				},
+				inputEnv:   inputEnv,
+				envConfigs: []envLayer{envConfig, patch},
+			},
+			want: want{
+				layers: []envLayer{
+					{kind: layerKindDefaultData, data: map[string]any{"a": "from-default"}},
+					{kind: layerKindContext, data: map[string]any{"a": "from-context"}},
+					envConfig,
+				},
+				patches: []envLayer{patch},
+			},
+		},
+		"ContextWins": {
+			reason: "Layers should be ordered as specified by the Input, ignoring the ones not listed",
+			args: args{
+				spec: &v1beta1.EnvironmentSpec{
+					DefaultData: map[string]extv1.JSON{"a": {Raw: []byte(`"from-default"`)}},
+					Precedence:  []v1beta1.PrecedenceLayer{v1beta1.PrecedenceLayerEnvironmentConfigs, v1beta1.PrecedenceLayerContext},
+				},
+				inputEnv:   inputEnv,
+				envConfigs: []envLayer{envConfig},
+			},
+			want: want{
+				layers: []envLayer{
+					envConfig,
+					{kind: layerKindContext, data: map[string]any{"a": "from-context"}},
+				},
+			},
+		},
+		"DuplicateLayer": {
+			reason: "Layers listed more than once should return an error",
+			args: args{
+				spec: &v1beta1.EnvironmentSpec{
+					Precedence: []v1beta1.PrecedenceLayer{v1beta1.PrecedenceLayerContext, v1beta1.PrecedenceLayerContext},
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			layers, patches, err := orderLayers(tc.args.spec, tc.args.inputEnv, tc.args.envConfigs)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\norderLayers(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.layers, layers, cmp.AllowUnexported(envLayer{})); diff != "" {
+				t.Errorf("%s\norderLayers(...): -want layers, +got layers:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.patches, patches, cmp.AllowUnexported(envLayer{})); diff != "" {
+				t.Errorf("%s\norderLayers(...): -want patches, +got patches:\n%s", tc.reason, diff)
 			}
 		})
 	}
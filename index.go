@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
+
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+// getIndexSources returns the sources listed by the EnvironmentConfig
+// referenced by the supplied index source, if found.
+func getIndexSources(spec *v1beta1.EnvironmentSpec, config v1beta1.EnvironmentSource, resources []resource.Required) ([]v1beta1.EnvironmentSource, error) {
+	idx, err := processSourceByReference(spec, config, resources)
+	if err != nil || idx == nil {
+		return nil, err
+	}
+	path := config.GetIndexFieldPath()
+	v, err := fieldpath.Pave(idx.Object).GetValue(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get sources at %q", path)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot marshal sources at %q", path)
+	}
+	var sources []v1beta1.EnvironmentSource
+	if err := json.Unmarshal(b, &sources); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal sources at %q", path)
+	}
+	for j, s := range sources {
+		switch s.GetType() {
+		case v1beta1.EnvironmentSourceTypeReference:
+			if s.Ref == nil {
+				return nil, errors.Errorf("ref of source %d at %q is required", j, path)
+			}
+		case v1beta1.EnvironmentSourceTypeSelector:
+			if s.Selector == nil {
+				return nil, errors.Errorf("selector of source %d at %q is required", j, path)
+			}
+		default:
+			return nil, errors.Errorf("type %q of source %d at %q is not supported by indexes", s.GetType(), j, path)
+		}
+	}
+	return sources, nil
+}
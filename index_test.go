@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	xpv1 "github.com/crossplane/crossplane-runtime/v2/apis/common/v1"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+func TestGetIndexSources(t *testing.T) {
+	index := func(sources ...any) []resource.Required {
+		return []resource.Required{{Resource: &unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "apiextensions.crossplane.io/v1beta1",
+			"kind":       "EnvironmentConfig",
+			"metadata":   map[string]any{"name": "platform"},
+			"data":       map[string]any{"environmentConfigs": sources},
+		}}}}
+	}
+
+	type args struct {
+		spec      *v1beta1.EnvironmentSpec
+		config    v1beta1.EnvironmentSource
+		resources []resource.Required
+	}
+	type want struct {
+		sources []v1beta1.EnvironmentSource
+		err     error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Sources": {
+			reason: "The sources listed by the index should be returned",
+			args: args{
+				spec:   &v1beta1.EnvironmentSpec{},
+				config: v1beta1.EnvironmentSource{Type: v1beta1.EnvironmentSourceTypeIndex, Ref: &v1beta1.EnvironmentSourceReference{Name: "platform"}},
+				resources: index(
+					map[string]any{"ref": map[string]any{"name": "foo"}},
+					map[string]any{"type": "Selector", "selector": map[string]any{}, "toFieldPath": "bar"},
+				),
+			},
+			want: want{
+				sources: []v1beta1.EnvironmentSource{
+					{Ref: &v1beta1.EnvironmentSourceReference{Name: "foo"}},
+					{Type: v1beta1.EnvironmentSourceTypeSelector, Selector: &v1beta1.EnvironmentSourceSelector{}, ToFieldPath: ptr.To("bar")},
+				},
+			},
+		},
+		"OptionalNotFound": {
+			reason: "Optional indexes not found should list no sources",
+			args: args{
+				spec:   &v1beta1.EnvironmentSpec{Policy: &v1beta1.Policy{Resolution: ptr.To(xpv1.ResolutionPolicyOptional)}},
+				config: v1beta1.EnvironmentSource{Type: v1beta1.EnvironmentSourceTypeIndex, Ref: &v1beta1.EnvironmentSourceReference{Name: "platform"}},
+			},
+			want: want{},
+		},
+		"NotFound": {
+			reason: "Required indexes not found should return an error",
+			args: args{
+				spec:   &v1beta1.EnvironmentSpec{},
+				config: v1beta1.EnvironmentSource{Type: v1beta1.EnvironmentSourceTypeIndex, Ref: &v1beta1.EnvironmentSourceReference{Name: "platform"}},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"NoSources": {
+			reason: "Indexes not holding sources at the configured path should return an error",
+			args: args{
+				spec:      &v1beta1.EnvironmentSpec{},
+				config:    v1beta1.EnvironmentSource{Type: v1beta1.EnvironmentSourceTypeIndex, Ref: &v1beta1.EnvironmentSourceReference{Name: "platform"}, IndexFieldPath: ptr.To("data.layers")},
+				resources: index(),
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"NestedIndex": {
+			reason: "Indexes listing other indexes should return an error",
+			args: args{
+				spec:      &v1beta1.EnvironmentSpec{},
+				config:    v1beta1.EnvironmentSource{Type: v1beta1.EnvironmentSourceTypeIndex, Ref: &v1beta1.EnvironmentSourceReference{Name: "platform"}},
+				resources: index(map[string]any{"type": "Index", "ref": map[string]any{"name": "foo"}}),
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := getIndexSources(tc.args.spec, tc.args.config, tc.args.resources)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\ngetIndexSources(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.sources, got); diff != "" {
+				t.Errorf("%s\ngetIndexSources(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -24,10 +24,44 @@ import (
 // An InputSpec specifies the environment for rendering composed
 // resources.
 type InputSpec struct {
+	// EnvironmentSpec specifies the environment written to ContextKey,
+	// `apiextensions.crossplane.io/environment` by default.
+	EnvironmentSpec `json:",inline"`
+
+	// Environments optionally specifies additional named environments, each
+	// computed from its own sources and written to its own Context key, e.g.
+	// to give different downstream functions a scoped view of the
+	// environment.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Environments []NamedEnvironment `json:"environments,omitempty"`
+}
+
+// A NamedEnvironment is an environment written to its own Context key.
+type NamedEnvironment struct {
+	// Name of the environment, unique across the Input.
+	Name string `json:"name"`
+
+	// EnvironmentSpec specifies the environment, ContextKey being required.
+	EnvironmentSpec `json:",inline"`
+}
+
+// An EnvironmentSpec specifies how an environment is computed and where it
+// is written.
+type EnvironmentSpec struct {
+	// ContextKey is the Context key the environment is read from, e.g. as
+	// set by a previous step, and written to. Defaults to
+	// `apiextensions.crossplane.io/environment`, required for named
+	// environments.
+	// +optional
+	ContextKey *string `json:"contextKey,omitempty"`
+
 	// DefaultData statically defines the initial state of the environment.
 	// It has the same schema-less structure as the data field in
 	// environment configs.
-	// It is overwritten by the selected environment configs.
+	// It is overwritten by the environment found in the Context and by the
+	// selected environment configs, unless specified otherwise by Precedence.
 	DefaultData map[string]extv1.JSON `json:"defaultData,omitempty"`
 
 	// EnvironmentConfigs selects a list of `EnvironmentConfig`s. The resolved
@@ -37,7 +71,8 @@ type InputSpec struct {
 	// The list of references is used to compute an in-memory environment at
 	// compose time. The data of all object is merged in the order they are
 	// listed, meaning the values of EnvironmentConfigs with a larger index take
-	// priority over ones with smaller indices.
+	// priority over ones with smaller indices, unless EnvironmentConfigs
+	// declare a different priority, see PriorityFieldPath.
 	//
 	// The computed environment can be accessed in a composition using
 	// `FromEnvironmentFieldPath` and `CombineFromEnvironment` patches.
@@ -48,6 +83,586 @@ type InputSpec struct {
 	// EnvironmentSourceReferences in EnvironmentConfigs list.
 	// +optional
 	Policy *Policy `json:"policy,omitempty"`
+
+	// Provenance optionally writes where each value of the computed
+	// environment comes from, i.e. the input context, the default data or an
+	// EnvironmentConfig, along with the index of its source and its name.
+	// +optional
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// ConflictPolicy specifies what happens when a value set by an
+	// EnvironmentConfig is overridden by a different value from another one.
+	// `Override` silently lets the latter win, `Warn` lets the latter win
+	// emitting a warning listing the conflicting paths and EnvironmentConfigs,
+	// `Error` fails the composite resource. It can be overridden by each
+	// source for the values it sets.
+	// +optional
+	// +kubebuilder:validation:Enum=Override;Warn;Error
+	// +kubebuilder:default=Override
+	ConflictPolicy *ConflictPolicy `json:"conflictPolicy,omitempty"`
+
+	// TypeCheck optionally reports merges changing the JSON type of a value,
+	// e.g. an object being overridden by a string, across all layers. Null
+	// values are compatible with any type.
+	// +optional
+	TypeCheck *TypeCheck `json:"typeCheck,omitempty"`
+
+	// DeleteSentinel is a string value that, when set for a key by a layer,
+	// deletes the key and any value set for it by lower layers, e.g. `~delete`.
+	// Keys can always be deleted setting them to a `$patch: delete` object.
+	// +optional
+	DeleteSentinel *string `json:"deleteSentinel,omitempty"`
+
+	// ListMerges configures how lists at specific paths of the environment
+	// are merged, by default lists are replaced as a whole.
+	// +optional
+	// +listType=map
+	// +listMapKey=path
+	ListMerges []ListMerge `json:"listMerges,omitempty"`
+
+	// Patches are JSON patch (RFC 6902) operations applied to the computed
+	// environment, after all the layers have been merged and the patches from
+	// EnvironmentConfigs have been applied. A failing `test` operation fails
+	// the composite resource.
+	// +optional
+	Patches []JSONPatchOperation `json:"patches,omitempty"`
+
+	// Precedence lists the layers the environment is computed from, in the
+	// order they are merged, so that later layers win over earlier ones.
+	// `DefaultData` is the Input's default data, `Context` is the environment
+	// found in the Function Context, e.g. set by a previous step, and
+	// `EnvironmentConfigs` are the selected EnvironmentConfigs. Layers not
+	// listed are ignored. Defaults to DefaultData, Context,
+	// EnvironmentConfigs.
+	// +optional
+	// +kubebuilder:validation:items:Enum=DefaultData;Context;EnvironmentConfigs
+	Precedence []PrecedenceLayer `json:"precedence,omitempty"`
+
+	// MergeMode specifies how the environment computed by this step is
+	// merged with the one found in the Context. `Override` merges the latter
+	// as a layer, see Precedence. `FillMissing` only adds the values missing
+	// in the environment found in the Context, at leaf granularity, never
+	// overriding a value set by a previous step; Context is then ignored in
+	// Precedence and patches apply to the environment computed by this step
+	// only.
+	// +optional
+	// +kubebuilder:validation:Enum=Override;FillMissing
+	// +kubebuilder:default=Override
+	MergeMode *MergeMode `json:"mergeMode,omitempty"`
+
+	// Exports write fields of the computed environment to the composite
+	// resource, e.g. to its status to show which values were used.
+	// +optional
+	Exports []Export `json:"exports,omitempty"`
+
+	// Output optionally emits the computed environment, or a subtree of it,
+	// as a desired composed ConfigMap or Secret.
+	// +optional
+	Output *Output `json:"output,omitempty"`
+
+	// Schema optionally validates the computed environment, except its
+	// apiVersion and kind, before it is written.
+	// +optional
+	Schema *Schema `json:"schema,omitempty"`
+
+	// RequiredKeys are field paths that must be set in the computed
+	// environment, optionally to a value of a given type or matching a
+	// pattern. All the keys violating them are reported in a single fatal
+	// result, along with the sources consulted.
+	// +optional
+	RequiredKeys []RequiredKey `json:"requiredKeys,omitempty"`
+
+	// Computed are values derived with CEL expressions, evaluated in order
+	// once the environment has been merged, patched and filled, so that
+	// later expressions can use the values computed by earlier ones.
+	// +optional
+	Computed []ComputedValue `json:"computed,omitempty"`
+
+	// RenderTemplates renders the Go templates held by string values set by
+	// EnvironmentConfigs or DefaultData, e.g.
+	// `{{ .xr.metadata.labels.team }}-logs`, once the environment has been
+	// merged and before values are computed. Templates can reference `.xr`,
+	// the observed composite resource, and `.env`, the merged environment.
+	// Templates referencing values held by other templates are rendered after
+	// them, cycles and missing keys fail the composite resource.
+	// +optional
+	RenderTemplates *bool `json:"renderTemplates,omitempty"`
+}
+
+// A ComputedValue is a value of the environment derived with a CEL
+// expression.
+type ComputedValue struct {
+	// ToFieldPath is where in the environment the value is written.
+	ToFieldPath string `json:"toFieldPath"`
+
+	// Expression is a CEL expression over `environment`, the computed
+	// environment, `xr`, the observed composite resource, and `context`, the
+	// Function Context, e.g. `environment.cluster.name + "-" +
+	// xr.metadata.name`.
+	Expression string `json:"expression"`
+}
+
+// RequiredKeyType is the JSON type of a required key.
+type RequiredKeyType string
+
+// Supported required key types.
+const (
+	RequiredKeyTypeString  RequiredKeyType = "String"
+	RequiredKeyTypeNumber  RequiredKeyType = "Number"
+	RequiredKeyTypeInteger RequiredKeyType = "Integer"
+	RequiredKeyTypeBoolean RequiredKeyType = "Boolean"
+	RequiredKeyTypeObject  RequiredKeyType = "Object"
+	RequiredKeyTypeArray   RequiredKeyType = "Array"
+)
+
+// A RequiredKey is a field path that must be set in the environment.
+type RequiredKey struct {
+	// FieldPath that must be set, e.g. `network.vpcId`. Null values are
+	// considered not set.
+	FieldPath string `json:"fieldPath"`
+
+	// Type the value must have.
+	// +optional
+	// +kubebuilder:validation:Enum=String;Number;Integer;Boolean;Object;Array
+	Type *RequiredKeyType `json:"type,omitempty"`
+
+	// Pattern is a regular expression the value must match, only string
+	// values can match it.
+	// +optional
+	Pattern *string `json:"pattern,omitempty"`
+}
+
+// DefaultSchemaFieldPath is the field path of the schema in the
+// EnvironmentConfig referenced by a Schema by default.
+const DefaultSchemaFieldPath = "data.schema"
+
+// A Schema is an OpenAPI v3 schema the environment is validated against.
+type Schema struct {
+	// Inline is the schema, e.g. `{"type": "object", "required": ["region"]}`.
+	// +optional
+	Inline *extv1.JSON `json:"inline,omitempty"`
+
+	// Ref references an EnvironmentConfig holding the schema, if Inline is
+	// not set.
+	// +optional
+	Ref *SchemaReference `json:"ref,omitempty"`
+
+	// Policy specifies how violations of the schema are reported. `Error`
+	// fails the composite resource, `Warn` emits a warning, both listing all
+	// violations with their field paths.
+	// +optional
+	// +kubebuilder:validation:Enum=Warn;Error
+	// +kubebuilder:default=Error
+	Policy *ViolationPolicy `json:"policy,omitempty"`
+}
+
+// GetPolicy returns the policy of the schema, returning the default if not
+// set.
+func (s *Schema) GetPolicy() ViolationPolicy {
+	if s == nil || s.Policy == nil {
+		return ViolationPolicyError
+	}
+	return *s.Policy
+}
+
+// A SchemaReference references an EnvironmentConfig holding a schema.
+type SchemaReference struct {
+	// Name of the EnvironmentConfig.
+	Name string `json:"name"`
+
+	// FieldPath of the schema in the EnvironmentConfig. Defaults to
+	// `data.schema`.
+	// +optional
+	FieldPath *string `json:"fieldPath,omitempty"`
+}
+
+// GetFieldPath returns the field path of the schema, returning the default
+// if not set.
+func (r *SchemaReference) GetFieldPath() string {
+	if r == nil || r.FieldPath == nil {
+		return DefaultSchemaFieldPath
+	}
+	return *r.FieldPath
+}
+
+// OutputKind is the kind of resource the environment is emitted as.
+type OutputKind string
+
+const (
+	// OutputKindConfigMap emits the environment as a ConfigMap.
+	OutputKindConfigMap OutputKind = "ConfigMap"
+	// OutputKindSecret emits the environment as a Secret.
+	OutputKindSecret OutputKind = "Secret"
+)
+
+// OutputFormat is how the environment is serialized in the emitted resource.
+type OutputFormat string
+
+const (
+	// OutputFormatFlatten writes a key for each leaf value, joining the
+	// field path segments with dots.
+	OutputFormatFlatten OutputFormat = "Flatten"
+	// OutputFormatJSON writes the environment as a single JSON document.
+	OutputFormatJSON OutputFormat = "JSON"
+	// OutputFormatYAML writes the environment as a single YAML document.
+	OutputFormatYAML OutputFormat = "YAML"
+)
+
+// DefaultOutputResourceName is the name of the desired composed resource the
+// environment is emitted as by default.
+const DefaultOutputResourceName = "environment"
+
+// An Output emits the environment as a desired composed resource.
+type Output struct {
+	// ResourceName is the name of the desired composed resource in the
+	// pipeline, unique across environments. Defaults to `environment`.
+	// +optional
+	ResourceName *string `json:"resourceName,omitempty"`
+
+	// Kind of the emitted resource.
+	// +optional
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	// +kubebuilder:default=ConfigMap
+	Kind *OutputKind `json:"kind,omitempty"`
+
+	// Name of the emitted resource. Generated by Crossplane if not set.
+	// +optional
+	Name *string `json:"name,omitempty"`
+
+	// Namespace of the emitted resource.
+	// +optional
+	Namespace *string `json:"namespace,omitempty"`
+
+	// Labels of the emitted resource.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// FromFieldPath is the path of the subtree of the environment to emit,
+	// the whole environment, except its apiVersion and kind, if not set.
+	// +optional
+	FromFieldPath *string `json:"fromFieldPath,omitempty"`
+
+	// Format specifies how the environment is serialized. `Flatten` writes a
+	// key for each leaf value, e.g. `network.cidr`, lists and non string
+	// values being written as JSON. `JSON` and `YAML` write a single
+	// document at Key.
+	// +optional
+	// +kubebuilder:validation:Enum=Flatten;JSON;YAML
+	// +kubebuilder:default=Flatten
+	Format *OutputFormat `json:"format,omitempty"`
+
+	// Key the document is written at by the `JSON` and `YAML` formats.
+	// Defaults to `environment.json` and `environment.yaml` respectively.
+	// +optional
+	Key *string `json:"key,omitempty"`
+}
+
+// GetResourceName returns the name of the desired composed resource,
+// returning the default if not set.
+func (o *Output) GetResourceName() string {
+	if o == nil || o.ResourceName == nil {
+		return DefaultOutputResourceName
+	}
+	return *o.ResourceName
+}
+
+// GetKind returns the kind of the emitted resource, returning the default if
+// not set.
+func (o *Output) GetKind() OutputKind {
+	if o == nil || o.Kind == nil {
+		return OutputKindConfigMap
+	}
+	return *o.Kind
+}
+
+// GetFormat returns the format of the emitted resource, returning the default
+// if not set.
+func (o *Output) GetFormat() OutputFormat {
+	if o == nil || o.Format == nil {
+		return OutputFormatFlatten
+	}
+	return *o.Format
+}
+
+// GetKey returns the key the document is written at, returning the default
+// for the format if not set.
+func (o *Output) GetKey() string {
+	switch {
+	case o != nil && o.Key != nil:
+		return *o.Key
+	case o.GetFormat() == OutputFormatYAML:
+		return "environment.yaml"
+	default:
+		return "environment.json"
+	}
+}
+
+// An Export writes a field of the environment to the composite resource.
+type Export struct {
+	// FromFieldPath is the path of the field of the environment to export,
+	// e.g. `network.region`.
+	FromFieldPath string `json:"fromFieldPath"`
+
+	// ToFieldPath is the path of the field of the composite resource the
+	// value is written to, e.g. `status.environment.region`.
+	ToFieldPath string `json:"toFieldPath"`
+
+	// Policy configures the specifics of the export, e.g. whether it fails if
+	// FromFieldPath is not found in the environment.
+	// +optional
+	Policy *PatchPolicy `json:"policy,omitempty"`
+}
+
+// DefaultEnvironmentContextKey is the Context key the environment is read from
+// and written to by default.
+const DefaultEnvironmentContextKey = "apiextensions.crossplane.io/environment"
+
+// GetContextKey returns the Context key of the environment, returning the
+// default if not set.
+func (s *EnvironmentSpec) GetContextKey() string {
+	if s == nil || s.ContextKey == nil {
+		return DefaultEnvironmentContextKey
+	}
+	return *s.ContextKey
+}
+
+// GetMergeMode returns the merge mode, returning the default if not set.
+func (s *EnvironmentSpec) GetMergeMode() MergeMode {
+	if s == nil || s.MergeMode == nil {
+		return MergeModeOverride
+	}
+	return *s.MergeMode
+}
+
+// MergeMode specifies how the computed environment is merged with the one
+// found in the Context.
+type MergeMode string
+
+const (
+	// MergeModeOverride merges the environment found in the Context as a
+	// layer.
+	MergeModeOverride MergeMode = "Override"
+	// MergeModeFillMissing only adds the values missing in the environment
+	// found in the Context.
+	MergeModeFillMissing MergeMode = "FillMissing"
+)
+
+// GetPrecedence returns the layers the environment is computed from, in merge
+// order, returning the default if not set.
+func (s *EnvironmentSpec) GetPrecedence() []PrecedenceLayer {
+	if s == nil || len(s.Precedence) == 0 {
+		return []PrecedenceLayer{PrecedenceLayerDefaultData, PrecedenceLayerContext, PrecedenceLayerEnvironmentConfigs}
+	}
+	return s.Precedence
+}
+
+// PrecedenceLayer is a layer the environment is computed from.
+type PrecedenceLayer string
+
+const (
+	// PrecedenceLayerDefaultData is the Input's default data.
+	PrecedenceLayerDefaultData PrecedenceLayer = "DefaultData"
+	// PrecedenceLayerContext is the environment found in the Function Context.
+	PrecedenceLayerContext PrecedenceLayer = "Context"
+	// PrecedenceLayerEnvironmentConfigs are the selected EnvironmentConfigs.
+	PrecedenceLayerEnvironmentConfigs PrecedenceLayer = "EnvironmentConfigs"
+)
+
+// JSONPatchOp is a JSON patch operation.
+type JSONPatchOp string
+
+// Supported JSON patch operations.
+const (
+	JSONPatchOpAdd     JSONPatchOp = "add"
+	JSONPatchOpRemove  JSONPatchOp = "remove"
+	JSONPatchOpReplace JSONPatchOp = "replace"
+	JSONPatchOpMove    JSONPatchOp = "move"
+	JSONPatchOpCopy    JSONPatchOp = "copy"
+	JSONPatchOpTest    JSONPatchOp = "test"
+)
+
+// A JSONPatchOperation is a JSON patch (RFC 6902) operation.
+type JSONPatchOperation struct {
+	// Op is the operation to perform.
+	// +kubebuilder:validation:Enum=add;remove;replace;move;copy;test
+	Op JSONPatchOp `json:"op"`
+
+	// Path is the JSON pointer to the target location, e.g. `/network/cidr`.
+	Path string `json:"path"`
+
+	// From is the JSON pointer to the source location of `move` and `copy`.
+	// +optional
+	From *string `json:"from,omitempty"`
+
+	// Value of `add`, `replace` and `test`.
+	// +optional
+	Value *extv1.JSON `json:"value,omitempty"`
+}
+
+// DecodeFormat is the format of a document held by a string value.
+type DecodeFormat string
+
+const (
+	// DecodeFormatJSON is a JSON document.
+	DecodeFormatJSON DecodeFormat = "JSON"
+	// DecodeFormatYAML is a YAML document.
+	DecodeFormatYAML DecodeFormat = "YAML"
+)
+
+// A DecodeField is a string value of an EnvironmentConfig holding a document
+// to be parsed.
+type DecodeField struct {
+	// FieldPath of the value in the EnvironmentConfig, e.g.
+	// `data.settings`.
+	FieldPath string `json:"fieldPath"`
+
+	// Format of the document held by the value.
+	// +kubebuilder:validation:Enum=JSON;YAML
+	Format DecodeFormat `json:"format"`
+}
+
+// PatchType is the type of patch held by an EnvironmentConfig.
+type PatchType string
+
+const (
+	// PatchTypeJSONPatch is a list of JSON patch (RFC 6902) operations.
+	PatchTypeJSONPatch PatchType = "JSONPatch"
+	// PatchTypeMergePatch is a JSON merge patch (RFC 7386) document.
+	PatchTypeMergePatch PatchType = "MergePatch"
+)
+
+// ListMergeBehavior specifies how a list is merged.
+type ListMergeBehavior string
+
+const (
+	// ListMergeBehaviorReplace replaces the list as a whole.
+	ListMergeBehaviorReplace ListMergeBehavior = "Replace"
+	// ListMergeBehaviorAppend appends the items to the list.
+	ListMergeBehaviorAppend ListMergeBehavior = "Append"
+	// ListMergeBehaviorMergeByKey deep merges items with the same key.
+	ListMergeBehaviorMergeByKey ListMergeBehavior = "MergeByKey"
+)
+
+// A ListMerge configures how a list of the environment is merged.
+type ListMerge struct {
+	// Path is the field path of the list in the environment, e.g.
+	// `network.subnets`. Lists nested in the items of lists merged by key are
+	// denoted by the path of the enclosing list followed by `[]`, e.g.
+	// `network.subnets[].tags`.
+	Path string `json:"path"`
+
+	// MergeKey is the key identifying the object items of the list, e.g.
+	// `name`, required by the `MergeByKey` behavior.
+	// +optional
+	MergeKey *string `json:"mergeKey,omitempty"`
+
+	// Behavior specifies how the list is merged. `Replace` replaces the list
+	// as a whole, `Append` appends the items of later layers, `MergeByKey`
+	// deep merges items with the same MergeKey, appending the others. Items
+	// with the `$patch: delete` directive delete the item with the same key.
+	// Defaults to `MergeByKey` if MergeKey is set, `Replace` otherwise.
+	// +optional
+	// +kubebuilder:validation:Enum=Replace;Append;MergeByKey
+	Behavior *ListMergeBehavior `json:"behavior,omitempty"`
+}
+
+// GetBehavior returns the behavior of the list merge, returning the default
+// if not set.
+func (l *ListMerge) GetBehavior() ListMergeBehavior {
+	switch {
+	case l == nil:
+		return ListMergeBehaviorReplace
+	case l.Behavior != nil:
+		return *l.Behavior
+	case l.MergeKey != nil:
+		return ListMergeBehaviorMergeByKey
+	default:
+		return ListMergeBehaviorReplace
+	}
+}
+
+// ViolationPolicy specifies how a violation is reported.
+type ViolationPolicy string
+
+const (
+	// ViolationPolicyWarn emits a warning.
+	ViolationPolicyWarn ViolationPolicy = "Warn"
+	// ViolationPolicyError fails the composite resource.
+	ViolationPolicyError ViolationPolicy = "Error"
+)
+
+// TypeCheck specifies how merges changing the JSON type of a value of the
+// environment are reported.
+type TypeCheck struct {
+	// Policy specifies whether a type change emits a warning or fails the
+	// composite resource.
+	// +optional
+	// +kubebuilder:validation:Enum=Warn;Error
+	// +kubebuilder:default=Error
+	Policy *ViolationPolicy `json:"policy,omitempty"`
+
+	// ExemptPaths are field paths of the environment, along with the ones
+	// nested under them, allowed to change type.
+	// +optional
+	ExemptPaths []string `json:"exemptPaths,omitempty"`
+}
+
+// GetPolicy returns the policy of the type check, returning the default if
+// not set.
+func (t *TypeCheck) GetPolicy() ViolationPolicy {
+	if t == nil || t.Policy == nil {
+		return ViolationPolicyError
+	}
+	return *t.Policy
+}
+
+// ConflictPolicy specifies what happens when EnvironmentConfigs set different
+// values for the same path.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyOverride lets the latter value win.
+	ConflictPolicyOverride ConflictPolicy = "Override"
+	// ConflictPolicyWarn lets the latter value win, emitting a warning.
+	ConflictPolicyWarn ConflictPolicy = "Warn"
+	// ConflictPolicyError fails the composite resource.
+	ConflictPolicyError ConflictPolicy = "Error"
+)
+
+// DefaultProvenanceContextKey is the Context key the provenance is written to
+// by default.
+const DefaultProvenanceContextKey = "environmentconfigs.fn.crossplane.io/provenance"
+
+// Provenance specifies where to write the provenance of the computed
+// environment, a map from each leaf field path of the environment to its
+// origin.
+type Provenance struct {
+	// ContextKey is the Context key the provenance is written to. Defaults to
+	// `environmentconfigs.fn.crossplane.io/provenance`, unless
+	// ToCompositeFieldPath is set.
+	// +optional
+	ContextKey *string `json:"contextKey,omitempty"`
+
+	// ToCompositeFieldPath is the field path of the composite resource the
+	// provenance is written to, e.g. `status.environmentProvenance`.
+	// +optional
+	ToCompositeFieldPath *string `json:"toCompositeFieldPath,omitempty"`
+}
+
+// GetContextKey returns the Context key the provenance should be written to,
+// returning the default if neither the key nor a composite field path are
+// set, or an empty string if it should not be written to the Context.
+func (p *Provenance) GetContextKey() string {
+	switch {
+	case p == nil:
+		return ""
+	case p.ContextKey != nil:
+		return *p.ContextKey
+	case p.ToCompositeFieldPath != nil:
+		return ""
+	default:
+		return DefaultProvenanceContextKey
+	}
 }
 
 // Policy represents the Resolution policy of Reference instance.
@@ -92,14 +707,23 @@ const (
 	EnvironmentSourceTypeReference EnvironmentSourceType = "Reference"
 	// EnvironmentSourceTypeSelector by labels.
 	EnvironmentSourceTypeSelector EnvironmentSourceType = "Selector"
+	// EnvironmentSourceTypeIndex by name, loading the sources it lists.
+	EnvironmentSourceTypeIndex EnvironmentSourceType = "Index"
+	// EnvironmentSourceTypeInline from data specified inline.
+	EnvironmentSourceTypeInline EnvironmentSourceType = "Inline"
+	// EnvironmentSourceTypeComposite from the observed composite resource.
+	EnvironmentSourceTypeComposite EnvironmentSourceType = "Composite"
 )
 
 // EnvironmentSource selects a EnvironmentConfig resource.
 type EnvironmentSource struct {
 	// Type specifies the way the EnvironmentConfig is selected.
-	// Default is `Reference`
+	// Default is `Reference`. `Index` references an EnvironmentConfig listing
+	// further sources at IndexFieldPath, which are loaded in its place.
+	// `Inline` loads Data as if it was the data of an EnvironmentConfig.
+	// `Composite` loads a subtree of the observed composite resource.
 	// +optional
-	// +kubebuilder:validation:Enum=Reference;Selector
+	// +kubebuilder:validation:Enum=Reference;Selector;Index;Inline;Composite
 	// +kubebuilder:default=Reference
 	Type EnvironmentSourceType `json:"type,omitempty"`
 
@@ -108,13 +732,190 @@ type EnvironmentSource struct {
 	// +optional
 	Ref *EnvironmentSourceReference `json:"ref,omitempty"`
 
+	// IndexFieldPath is the path to the list of sources held by the
+	// EnvironmentConfig referenced by an `Index` source. Listed sources can be
+	// references or selectors, but not indexes, each with its own
+	// ToFieldPath, the one of the index being ignored. Defaults to
+	// `data.environmentConfigs`.
+	// +optional
+	IndexFieldPath *string `json:"indexFieldPath,omitempty"`
+
 	// Selector selects EnvironmentConfig(s) via labels.
 	// +optional
 	Selector *EnvironmentSourceSelector `json:"selector,omitempty"`
 
+	// Data of an `Inline` source. It has the same schema-less structure as
+	// the data field in environment configs, and is merged in the position
+	// of the source like the data of a selected EnvironmentConfig.
+	// +optional
+	Data map[string]extv1.JSON `json:"data,omitempty"`
+
+	// Composite specifies the subtree of the observed composite resource
+	// loaded by a `Composite` source.
+	// +optional
+	Composite *CompositeSource `json:"composite,omitempty"`
+
 	// ToFieldPath specifies where in the environment to load the EnvironmentConfig(s).
 	// +optional
 	ToFieldPath *string `json:"toFieldPath,omitempty"`
+
+	// PriorityFieldPath is the path to an integer field of the selected
+	// EnvironmentConfig(s) declaring the priority they should be merged with.
+	// If not set, the priority is read from the
+	// `environmentconfigs.fn.crossplane.io/priority` annotation.
+	// EnvironmentConfigs are merged by ascending priority across all sources,
+	// ones with the same priority keep their relative order. EnvironmentConfigs
+	// not declaring a priority default to 0.
+	// +optional
+	PriorityFieldPath *string `json:"priorityFieldPath,omitempty"`
+
+	// Priority is the priority the data of an `Inline` or `Composite` source
+	// is merged with, among the EnvironmentConfigs of all sources, see
+	// PriorityFieldPath. Defaults to 0.
+	// +optional
+	Priority *int64 `json:"priority,omitempty"`
+
+	// Aggregation specifies how the EnvironmentConfig(s) selected by this
+	// source are loaded into the environment. `Merge` deep merges their data,
+	// `List` loads the list of their data at ToFieldPath, which is then
+	// required, `MapByName` and `MapByFieldPath` load a map of their data
+	// keyed by their name or by the value at AggregationKeyFieldPath.
+	// Aggregated EnvironmentConfigs are merged as a whole, with the highest
+	// priority among them.
+	// +optional
+	// +kubebuilder:validation:Enum=Merge;List;MapByName;MapByFieldPath
+	// +kubebuilder:default=Merge
+	Aggregation EnvironmentSourceAggregation `json:"aggregation,omitempty"`
+
+	// AggregationKeyFieldPath is the path to the field of the selected
+	// EnvironmentConfigs used as key by the `MapByFieldPath` aggregation.
+	// +optional
+	AggregationKeyFieldPath *string `json:"aggregationKeyFieldPath,omitempty"`
+
+	// Aggregate reduces the values of a field across all the
+	// EnvironmentConfigs selected by this source, e.g. in Multiple mode, into
+	// a single value written to the environment. Aggregated values are merged
+	// after the data of the selected EnvironmentConfigs, with the highest
+	// priority among them.
+	// +optional
+	Aggregate []FieldAggregation `json:"aggregate,omitempty"`
+
+	// IncludeMetadata writes metadata of the selected EnvironmentConfig(s) to
+	// the environment, e.g. to know which EnvironmentConfig was used.
+	// +optional
+	IncludeMetadata *IncludeMetadata `json:"includeMetadata,omitempty"`
+
+	// PatchType, if set, makes the selected EnvironmentConfig(s) hold at
+	// `data.patch` a patch of this type, applied to the environment after all
+	// layers have been merged, instead of data to be merged. ToFieldPath is
+	// not supported, patches apply to the whole environment.
+	// +optional
+	// +kubebuilder:validation:Enum=JSONPatch;MergePatch
+	PatchType *PatchType `json:"patchType,omitempty"`
+
+	// Decode parses string values of the selected EnvironmentConfig(s)
+	// holding JSON or YAML documents into structured values, before they are
+	// merged, e.g. `settings: '{"a": 1}'`. Values not found are skipped.
+	// Values encrypted with SOPS can't be decoded, as they are only
+	// decrypted when merged.
+	// +optional
+	Decode []DecodeField `json:"decode,omitempty"`
+
+	// ConflictPolicy overrides the Input's ConflictPolicy for the values set
+	// by this source.
+	// +optional
+	// +kubebuilder:validation:Enum=Override;Warn;Error
+	ConflictPolicy *ConflictPolicy `json:"conflictPolicy,omitempty"`
+}
+
+// CompositeSource specifies the subtree of the observed composite resource
+// loaded into the environment.
+type CompositeSource struct {
+	// FromFieldPath is the path to an object of the observed composite
+	// resource, e.g. `spec.parameters.overrides`. Nothing is loaded if the
+	// composite resource does not set it.
+	FromFieldPath string `json:"fromFieldPath"`
+
+	// AllowedKeys are the paths, relative to FromFieldPath, of the values
+	// that can be loaded, along with the values nested under them, e.g.
+	// `replicas` or `network.cidr`. Values set by the composite resource
+	// outside of them fail the composite resource.
+	// +kubebuilder:validation:MinItems=1
+	AllowedKeys []string `json:"allowedKeys"`
+}
+
+// MetadataField is a field of the metadata of an EnvironmentConfig.
+type MetadataField string
+
+// Supported metadata fields.
+const (
+	MetadataFieldName            MetadataField = "name"
+	MetadataFieldLabels          MetadataField = "labels"
+	MetadataFieldAnnotations     MetadataField = "annotations"
+	MetadataFieldResourceVersion MetadataField = "resourceVersion"
+	MetadataFieldUID             MetadataField = "uid"
+)
+
+// IncludeMetadata specifies which metadata of the selected
+// EnvironmentConfig(s) to write to the environment and where.
+type IncludeMetadata struct {
+	// ToFieldPath is where in the environment the metadata is written, e.g.
+	// `_sources.network`. The metadata is written as a list in Multiple mode,
+	// as an object otherwise.
+	ToFieldPath string `json:"toFieldPath"`
+
+	// Fields of the metadata to include, all the supported ones if not set.
+	// +optional
+	// +kubebuilder:validation:items:Enum=name;labels;annotations;resourceVersion;uid
+	Fields []MetadataField `json:"fields,omitempty"`
+}
+
+// GetFields returns the metadata fields to include, returning all the
+// supported ones if not set.
+func (m *IncludeMetadata) GetFields() []MetadataField {
+	if m == nil || len(m.Fields) == 0 {
+		return []MetadataField{MetadataFieldName, MetadataFieldLabels, MetadataFieldAnnotations, MetadataFieldResourceVersion, MetadataFieldUID}
+	}
+	return m.Fields
+}
+
+// AggregateOperation specifies how values are reduced by a FieldAggregation.
+type AggregateOperation string
+
+const (
+	// AggregateOperationConcat concatenates the values, flattening lists.
+	AggregateOperationConcat AggregateOperation = "Concat"
+	// AggregateOperationUnique concatenates the values, flattening lists and
+	// dropping duplicates.
+	AggregateOperationUnique AggregateOperation = "Unique"
+	// AggregateOperationSum sums numeric values.
+	AggregateOperationSum AggregateOperation = "Sum"
+	// AggregateOperationMin returns the minimum among numeric or string
+	// values.
+	AggregateOperationMin AggregateOperation = "Min"
+	// AggregateOperationMax returns the maximum among numeric or string
+	// values.
+	AggregateOperationMax AggregateOperation = "Max"
+	// AggregateOperationCount counts the EnvironmentConfigs having the field.
+	AggregateOperationCount AggregateOperation = "Count"
+)
+
+// A FieldAggregation reduces the values of a field across the selected
+// EnvironmentConfigs into a single value.
+type FieldAggregation struct {
+	// FromFieldPath is the path to the field of each selected
+	// EnvironmentConfig to aggregate, e.g. `data.allowedCidrs`.
+	// EnvironmentConfigs not having the field are skipped. If not set, `Count`
+	// counts all the selected EnvironmentConfigs.
+	// +optional
+	FromFieldPath string `json:"fromFieldPath,omitempty"`
+
+	// Operation used to reduce the values.
+	// +kubebuilder:validation:Enum=Concat;Unique;Sum;Min;Max;Count
+	Operation AggregateOperation `json:"operation"`
+
+	// ToFieldPath is where in the environment the result is written.
+	ToFieldPath string `json:"toFieldPath"`
 }
 
 // GetType returns the type of the environment source, returning the default if not set.
@@ -125,6 +926,43 @@ func (e *EnvironmentSource) GetType() EnvironmentSourceType {
 	return e.Type
 }
 
+// GetIndexFieldPath returns the path to the list of sources held by an index,
+// returning the default if not set.
+func (e *EnvironmentSource) GetIndexFieldPath() string {
+	if e == nil || e.IndexFieldPath == nil {
+		return "data.environmentConfigs"
+	}
+	return *e.IndexFieldPath
+}
+
+// GetAggregation returns the aggregation of the environment source, returning
+// the default if not set.
+func (e *EnvironmentSource) GetAggregation() EnvironmentSourceAggregation {
+	if e == nil || e.Aggregation == "" {
+		return EnvironmentSourceAggregationMerge
+	}
+	return e.Aggregation
+}
+
+// EnvironmentSourceAggregation specifies how the EnvironmentConfigs selected
+// by a source are loaded into the environment.
+type EnvironmentSourceAggregation string
+
+const (
+	// EnvironmentSourceAggregationMerge deep merges the data of the selected
+	// EnvironmentConfigs.
+	EnvironmentSourceAggregationMerge EnvironmentSourceAggregation = "Merge"
+	// EnvironmentSourceAggregationList collects the data of the selected
+	// EnvironmentConfigs in a list.
+	EnvironmentSourceAggregationList EnvironmentSourceAggregation = "List"
+	// EnvironmentSourceAggregationMapByName collects the data of the selected
+	// EnvironmentConfigs in a map keyed by their name.
+	EnvironmentSourceAggregationMapByName EnvironmentSourceAggregation = "MapByName"
+	// EnvironmentSourceAggregationMapByFieldPath collects the data of the
+	// selected EnvironmentConfigs in a map keyed by the value of a field.
+	EnvironmentSourceAggregationMapByFieldPath EnvironmentSourceAggregation = "MapByFieldPath"
+)
+
 // An EnvironmentSourceReference references an EnvironmentConfig by it's name.
 type EnvironmentSourceReference struct {
 	// The name of the object.
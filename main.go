@@ -2,7 +2,11 @@
 package main
 
 import (
+	"os"
+
+	"filippo.io/age"
 	"github.com/alecthomas/kong"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
 
 	"github.com/crossplane/function-sdk-go"
 )
@@ -16,6 +20,7 @@ type CLI struct {
 	TLSCertsDir        string `env:"TLS_SERVER_CERTS_DIR"                                                                           help:"Directory containing server certs (tls.key, tls.crt) and the CA used to verify client certificates (ca.crt)"`
 	Insecure           bool   `help:"Run without mTLS credentials. If you supply this flag --tls-server-certs-dir will be ignored."`
 	MaxRecvMessageSize int    `default:"4"                                                                                          help:"Maximum size of received messages in MB."`
+	AgeKeyFile         string `env:"SOPS_AGE_KEY_FILE"                                                                              help:"File containing the age identities used to decrypt SOPS encrypted EnvironmentConfigs."`
 }
 
 // Run this Function.
@@ -25,13 +30,31 @@ func (c *CLI) Run() error {
 		return err
 	}
 
-	return function.Serve(&Function{log: log},
+	f := &Function{log: log}
+	if c.AgeKeyFile != "" {
+		if f.identities, err = loadIdentities(c.AgeKeyFile); err != nil {
+			return err
+		}
+	}
+
+	return function.Serve(f,
 		function.Listen(c.Network, c.Address),
 		function.MTLSCertificates(c.TLSCertsDir),
 		function.Insecure(c.Insecure),
 		function.MaxRecvMessageSize(c.MaxRecvMessageSize*1024*1024))
 }
 
+// loadIdentities loads the age identities from the supplied file.
+func loadIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path) //nolint:gosec // the path is supplied by the operator
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open age key file")
+	}
+	defer f.Close() //nolint:errcheck // only read from
+	ids, err := age.ParseIdentities(f)
+	return ids, errors.Wrap(err, "cannot parse age key file")
+}
+
 func main() {
 	ctx := kong.Parse(&CLI{}, kong.Description("A Crossplane Composition Function."))
 	ctx.FatalIfErrorf(ctx.Run())
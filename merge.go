@@ -0,0 +1,577 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+// layerKind is the kind of layer a value of the environment comes from.
+type layerKind string
+
+const (
+	// layerKindContext is the environment found in the Function context.
+	layerKindContext layerKind = "Context"
+	// layerKindDefaultData is the default data specified in the Input.
+	layerKindDefaultData layerKind = "DefaultData"
+	// layerKindEnvironmentConfig is the data of one or more EnvironmentConfigs.
+	layerKindEnvironmentConfig layerKind = "EnvironmentConfig"
+	// layerKindPatch is a patch applied to the merged environment, either
+	// inline in the Input or from an EnvironmentConfig.
+	layerKindPatch layerKind = "Patch"
+	// layerKindComputed is a value computed with a CEL expression.
+	layerKindComputed layerKind = "Computed"
+	// layerKindComposite is a subtree of the observed composite resource.
+	layerKindComposite layerKind = "Composite"
+)
+
+// origin describes where a value of the environment comes from.
+type origin struct {
+	// kind of the layer the value comes from.
+	kind layerKind
+	// source is the index of the EnvironmentSource the value comes from, only
+	// meaningful for EnvironmentConfig layers.
+	source int
+	// name of the EnvironmentConfig(s) the value comes from, if any.
+	name string
+}
+
+// originOf returns the origin of the values of the supplied layer.
+func originOf(l envLayer) origin {
+	return origin{kind: l.kind, source: l.source, name: l.name}
+}
+
+// asMap returns the origin as a map, to be written to the provenance.
+func (o origin) asMap() map[string]any {
+	out := map[string]any{"layer": string(o.kind)}
+	if o.kind == layerKindEnvironmentConfig || (o.kind == layerKindPatch && o.name != "") {
+		out["source"] = int64(o.source)
+		out["name"] = o.name
+	}
+	if o.kind == layerKindComposite {
+		out["source"] = int64(o.source)
+	}
+	return out
+}
+
+// String returns a human readable description of the origin.
+func (o origin) String() string {
+	switch o.kind {
+	case layerKindContext:
+		return "context environment"
+	case layerKindDefaultData:
+		return "default data"
+	case layerKindComputed:
+		return "computed value"
+	case layerKindComposite:
+		return fmt.Sprintf("composite resource (source %d)", o.source)
+	case layerKindPatch:
+		if o.name == "" {
+			return "inline patch"
+		}
+		return fmt.Sprintf("patch from environment config %q (source %d)", o.name, o.source)
+	default:
+		if o.name == "" {
+			return fmt.Sprintf("inline data (source %d)", o.source)
+		}
+		return fmt.Sprintf("environment config %q (source %d)", o.name, o.source)
+	}
+}
+
+// A conflict is a value set by an EnvironmentConfig layer being overridden by
+// a different value from another one.
+type conflict struct {
+	// path of the overridden value.
+	path string
+	// previous origins of the overridden value, or of the values nested under
+	// it.
+	previous []origin
+	// origin of the overriding value.
+	origin origin
+}
+
+// String returns a human readable description of the conflict.
+func (c conflict) String() string {
+	previous := make([]string, 0, len(c.previous))
+	for _, o := range c.previous {
+		previous = append(previous, o.String())
+	}
+	return fmt.Sprintf("%q: %s overridden by %s", c.path, strings.Join(previous, ", "), c.origin)
+}
+
+// A typeChange is a value being overridden by a value of a different JSON
+// type.
+type typeChange struct {
+	// path of the overridden value.
+	path string
+	// from and to are the JSON types of the overridden and overriding values.
+	from, to string
+	// previous origins of the overridden value, or of the values nested under
+	// it.
+	previous []origin
+	// origin of the overriding value.
+	origin origin
+}
+
+// String returns a human readable description of the type change.
+func (c typeChange) String() string {
+	previous := make([]string, 0, len(c.previous))
+	for _, o := range c.previous {
+		previous = append(previous, o.String())
+	}
+	return fmt.Sprintf("%q: %s from %s changed to %s by %s", c.path, c.from, strings.Join(previous, ", "), c.to, c.origin)
+}
+
+// patchDirectiveKey is the key of a map holding a merge directive, e.g.
+// `$patch: delete`.
+const patchDirectiveKey = "$patch"
+
+// patchDirectiveDelete deletes the value holding it.
+const patchDirectiveDelete = "delete"
+
+// mergeOptions configure a merger.
+type mergeOptions struct {
+	// deleteSentinel is a string value deleting the key it is set for, if not
+	// empty.
+	deleteSentinel string
+	// listMerges configures how lists are merged, by field path.
+	listMerges map[string]v1beta1.ListMerge
+	// trackOrigins records the origin of each leaf of the merged data, needed
+	// to report provenance, conflicts and type changes.
+	trackOrigins bool
+}
+
+// A merger deep merges maps, keeping track of the origin of each leaf of the
+// merged data if configured to.
+type merger struct {
+	mergeOptions
+
+	// origins of the leaves of the merged data, nil if not tracked.
+	origins *originTree
+	// conflicts found while merging.
+	conflicts []conflict
+	// typeChanges found while merging.
+	typeChanges []typeChange
+}
+
+// newMerger returns a new merger configured with the supplied options.
+func newMerger(o mergeOptions) *merger {
+	m := &merger{mergeOptions: o}
+	if o.trackOrigins {
+		m.origins = &originTree{}
+	}
+	return m
+}
+
+// merge deep merges src into dst, returning the result. Values in src win
+// over the ones in dst, maps are merged recursively while any other value,
+// including lists, is replaced as a whole, unless configured otherwise for
+// lists at specific paths. Tombstones in src, i.e.
+// `$patch: delete` maps or the delete sentinel, delete the keys they are set
+// for. Neither dst nor src are modified.
+func (m *merger) merge(dst, src map[string]any, o origin) map[string]any {
+	return m.mergeMap("", m.origins, dst, src, o)
+}
+
+// mergeMap merges src into dst, found at path, whose origins are recorded in
+// t, if tracked.
+func (m *merger) mergeMap(path string, t *originTree, dst, src map[string]any, o origin) map[string]any {
+	out := make(map[string]any, len(dst))
+	maps.Copy(out, dst)
+	for k, v := range src {
+		p := appendPath(path, k)
+		s := fieldSegment(k)
+		if m.isTombstone(v) {
+			delete(out, k)
+			t.drop(s)
+			continue
+		}
+		if sv, ok := v.(map[string]any); ok {
+			if dv, ok := out[k].(map[string]any); ok {
+				out[k] = m.mergeMap(p, t.child(s), dv, sv, o)
+				continue
+			}
+		}
+		if sl, ok := v.([]any); ok {
+			if lm, ok := m.listMerges[p]; ok && lm.GetBehavior() != v1beta1.ListMergeBehaviorReplace {
+				dl, isList := out[k].([]any)
+				if dv, ok := out[k]; ok && !isList {
+					m.checkTypeChange(p, t.get(s), dv, v, o)
+				}
+				out[k] = m.mergeList(p, dl, sl, lm)
+				t.child(s).set(out[k], o)
+				continue
+			}
+		}
+		if dv, ok := out[k]; ok && !reflect.DeepEqual(dv, v) {
+			m.checkConflict(p, t.get(s), o)
+			m.checkTypeChange(p, t.get(s), dv, v, o)
+		}
+		v = m.dropTombstones(v)
+		t.child(s).set(v, o)
+		out[k] = v
+	}
+	return out
+}
+
+// fillMissing returns src filled into dst, where only the values missing in
+// dst are set, at leaf granularity, so that no value of dst is ever
+// overridden. Values of dst are recorded with the supplied origin, while the
+// filled ones keep the origin already recorded. Neither dst nor src are
+// modified.
+func (m *merger) fillMissing(dst, src map[string]any, o origin) map[string]any {
+	return m.fillMap(m.origins, dst, src, o)
+}
+
+func (m *merger) fillMap(t *originTree, dst, src map[string]any, o origin) map[string]any {
+	out := make(map[string]any, len(src))
+	maps.Copy(out, src)
+	for k, v := range dst {
+		s := fieldSegment(k)
+		if dv, ok := v.(map[string]any); ok {
+			if sv, ok := out[k].(map[string]any); ok {
+				out[k] = m.fillMap(t.child(s), dv, sv, o)
+				continue
+			}
+		}
+		t.child(s).set(v, o)
+		out[k] = v
+	}
+	return out
+}
+
+// mergeList merges the src list, found at path, into the dst one according to
+// the supplied configuration, returning the result. Lists are either appended
+// or merged by key, in which case src items with the same key as a dst one
+// are deep merged into it, or delete it if they are tombstones, while other
+// items are appended. Neither dst nor src are modified.
+func (m *merger) mergeList(path string, dst, src []any, lm v1beta1.ListMerge) []any {
+	out := slices.Clone(dst)
+	if out == nil {
+		out = make([]any, 0, len(src))
+	}
+	for _, item := range src {
+		mi, ok := item.(map[string]any)
+		if !ok {
+			out = append(out, item)
+			continue
+		}
+		kv, hasKey := mi[ptr.Deref(lm.MergeKey, "")]
+		if lm.GetBehavior() != v1beta1.ListMergeBehaviorMergeByKey || !hasKey {
+			if !m.isTombstone(mi) {
+				out = append(out, m.dropTombstones(mi))
+			}
+			continue
+		}
+		i := slices.IndexFunc(out, func(v any) bool {
+			mv, ok := v.(map[string]any)
+			return ok && reflect.DeepEqual(mv[*lm.MergeKey], kv)
+		})
+		switch {
+		case m.isTombstone(mi):
+			if i >= 0 {
+				out = slices.Delete(out, i, i+1)
+			}
+		case i >= 0:
+			// Items are merged as a whole, origins of nested values are only
+			// tracked for the list. Lists nested in items are configured by
+			// the path of the list followed by `[]`, e.g. `subnets[].tags`.
+			out[i] = m.mergeMap(path+"[]", nil, out[i].(map[string]any), mi, origin{}) //nolint:forcetypeassert // checked by IndexFunc
+		default:
+			out = append(out, m.dropTombstones(mi))
+		}
+	}
+	return out
+}
+
+// isTombstone returns true if the supplied value deletes the key it is set
+// for.
+func (m *merger) isTombstone(v any) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		return v[patchDirectiveKey] == patchDirectiveDelete
+	case string:
+		return m.deleteSentinel != "" && v == m.deleteSentinel
+	default:
+		return false
+	}
+}
+
+// dropTombstones returns the supplied value without the tombstones nested in
+// it, as there is nothing to delete there. The value is not modified.
+func (m *merger) dropTombstones(v any) any {
+	mv, ok := v.(map[string]any)
+	if !ok {
+		return v
+	}
+	out := make(map[string]any, len(mv))
+	for k, v := range mv {
+		if m.isTombstone(v) {
+			continue
+		}
+		out[k] = m.dropTombstones(v)
+	}
+	return out
+}
+
+// checkConflict records a conflict if the value at the supplied path, about to
+// be overridden by a different one, was set by other EnvironmentConfig layers,
+// as recorded in t.
+func (m *merger) checkConflict(path string, t *originTree, o origin) {
+	if o.kind != layerKindEnvironmentConfig {
+		return
+	}
+	c := conflict{path: path, origin: o}
+	for _, prev := range t.distinct() {
+		if prev.kind == layerKindEnvironmentConfig && prev != o {
+			c.previous = append(c.previous, prev)
+		}
+	}
+	if len(c.previous) > 0 {
+		m.conflicts = append(m.conflicts, c)
+	}
+}
+
+// checkTypeChange records a type change if the value at the supplied path,
+// whose origins are recorded in t, is about to be overridden by a value of a
+// different JSON type. Null values are compatible with any type. Type changes
+// are only checked if origins are tracked.
+func (m *merger) checkTypeChange(path string, t *originTree, from, to any, o origin) {
+	if m.origins == nil {
+		return
+	}
+	ft, tt := jsonType(from), jsonType(to)
+	if ft == tt || ft == "null" || tt == "null" {
+		return
+	}
+	m.typeChanges = append(m.typeChanges, typeChange{path: path, from: ft, to: tt, previous: t.distinct(), origin: o})
+}
+
+// track records the supplied origin for the values that changed from before to
+// after at the supplied path, e.g. because of a patch, forgetting the origins
+// of the removed ones.
+func (m *merger) track(path string, before, after any, o origin) {
+	if m.origins == nil {
+		return
+	}
+	segments, err := fieldpath.Parse(path)
+	if err != nil {
+		return
+	}
+	t := m.origins
+	for _, s := range segments {
+		t = t.child(s)
+	}
+	t.track(before, after, o)
+}
+
+// lookup returns the origin recorded for the leaf at the supplied path, if
+// any.
+func (m *merger) lookup(path string) (origin, bool) {
+	if m.origins == nil {
+		return origin{}, false
+	}
+	segments, err := fieldpath.Parse(path)
+	if err != nil {
+		return origin{}, false
+	}
+	t := m.origins
+	for _, s := range segments {
+		if t = t.get(s); t == nil {
+			return origin{}, false
+		}
+	}
+	if t.origin == nil {
+		return origin{}, false
+	}
+	return *t.origin, true
+}
+
+// provenance returns the origin of each leaf of the merged data, keyed by
+// field path.
+func (m *merger) provenance() map[string]any {
+	out := map[string]any{}
+	m.origins.walk("", func(path string, o origin) {
+		out[path] = o.asMap()
+	})
+	return out
+}
+
+// An originTree holds the origins of the leaves of the merged data, mirroring
+// its structure. All its methods are no-ops on a nil tree, i.e. if origins are
+// not tracked.
+type originTree struct {
+	// origin of the value, if a leaf.
+	origin *origin
+	// children are the trees of the values nested under the value.
+	children map[fieldpath.Segment]*originTree
+}
+
+// fieldSegment returns the field path segment of the supplied key.
+func fieldSegment(key string) fieldpath.Segment {
+	return fieldpath.Segment{Type: fieldpath.SegmentField, Field: key}
+}
+
+// get returns the tree of the value nested under the supplied segment, if
+// any.
+func (t *originTree) get(s fieldpath.Segment) *originTree {
+	if t == nil {
+		return nil
+	}
+	return t.children[s]
+}
+
+// child returns the tree of the value nested under the supplied segment,
+// creating it if needed.
+func (t *originTree) child(s fieldpath.Segment) *originTree {
+	if t == nil {
+		return nil
+	}
+	if c, ok := t.children[s]; ok {
+		return c
+	}
+	if t.children == nil {
+		t.children = map[fieldpath.Segment]*originTree{}
+	}
+	c := &originTree{}
+	t.children[s] = c
+	return c
+}
+
+// drop forgets the origins of the value nested under the supplied segment.
+func (t *originTree) drop(s fieldpath.Segment) {
+	if t == nil {
+		return
+	}
+	delete(t.children, s)
+}
+
+// set records the supplied origin for all the leaves of the supplied value,
+// forgetting the ones previously recorded.
+func (t *originTree) set(v any, o origin) {
+	if t == nil {
+		return
+	}
+	t.origin, t.children = nil, nil
+	if mv, ok := v.(map[string]any); ok && len(mv) > 0 {
+		for k, v := range mv {
+			t.child(fieldSegment(k)).set(v, o)
+		}
+		return
+	}
+	t.origin = &o
+}
+
+// track records the supplied origin for the leaves that changed from before to
+// after, forgetting the origins of the removed ones.
+func (t *originTree) track(before, after any, o origin) {
+	bm, bok := before.(map[string]any)
+	am, aok := after.(map[string]any)
+	if bok && aok {
+		for k, v := range am {
+			if bv, ok := bm[k]; ok {
+				t.child(fieldSegment(k)).track(bv, v, o)
+				continue
+			}
+			t.child(fieldSegment(k)).set(v, o)
+		}
+		for k := range bm {
+			if _, ok := am[k]; !ok {
+				t.drop(fieldSegment(k))
+			}
+		}
+		return
+	}
+	if reflect.DeepEqual(before, after) {
+		return
+	}
+	t.set(after, o)
+}
+
+// walk calls fn with the field path and origin of each recorded leaf, sorted
+// by field path.
+func (t *originTree) walk(path string, fn func(path string, o origin)) {
+	if t == nil {
+		return
+	}
+	if len(t.children) == 0 {
+		if t.origin != nil {
+			fn(path, *t.origin)
+		}
+		return
+	}
+	segments := slices.SortedFunc(maps.Keys(t.children), func(a, b fieldpath.Segment) int {
+		if a.Type != b.Type {
+			return cmp.Compare(a.Type, b.Type)
+		}
+		if c := cmp.Compare(a.Field, b.Field); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Index, b.Index)
+	})
+	for _, s := range segments {
+		p := appendPath(path, s.Field)
+		if s.Type == fieldpath.SegmentIndex {
+			p = fmt.Sprintf("%s[%d]", path, s.Index)
+		}
+		t.children[s].walk(p, fn)
+	}
+}
+
+// distinct returns the distinct origins of the recorded leaves, sorted by
+// field path.
+func (t *originTree) distinct() []origin {
+	out := make([]origin, 0)
+	t.walk("", func(_ string, o origin) {
+		if !slices.Contains(out, o) {
+			out = append(out, o)
+		}
+	})
+	return out
+}
+
+// jsonType returns the JSON type of the supplied value.
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64, float64, int, int32, float32:
+		return "number"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// appendPath appends a key to a field path, using the bracket notation for
+// keys that would not be parsed correctly otherwise.
+func appendPath(path, key string) string {
+	if strings.ContainsAny(key, ".[]") {
+		return path + "[" + key + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// isPathUnder returns true if the field path p is path itself or is nested
+// under it.
+func isPathUnder(p, path string) bool {
+	return p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(p, path+"[")
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+func TestMerge(t *testing.T) {
+	type args struct {
+		opts   mergeOptions
+		layers []envLayer
+	}
+	type want struct {
+		merged      map[string]any
+		provenance  map[string]any
+		conflicts   []conflict
+		typeChanges []typeChange
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"DeepMerge": {
+			reason: "Later layers should win over earlier ones, merging maps recursively and tracking the origin of each leaf",
+			args: args{
+				layers: []envLayer{
+					{kind: layerKindDefaultData, data: map[string]any{
+						"a": "from-default",
+						"b": map[string]any{"c": "from-default", "d": "from-default"},
+					}},
+					{kind: layerKindEnvironmentConfig, source: 1, name: "foo", data: map[string]any{
+						"b": map[string]any{"d": "from-foo"},
+						"e": []any{"from-foo"},
+					}},
+				},
+			},
+			want: want{
+				merged: map[string]any{
+					"a": "from-default",
+					"b": map[string]any{"c": "from-default", "d": "from-foo"},
+					"e": []any{"from-foo"},
+				},
+				provenance: map[string]any{
+					"a":   map[string]any{"layer": "DefaultData"},
+					"b.c": map[string]any{"layer": "DefaultData"},
+					"b.d": map[string]any{"layer": "EnvironmentConfig", "source": int64(1), "name": "foo"},
+					"e":   map[string]any{"layer": "EnvironmentConfig", "source": int64(1), "name": "foo"},
+				},
+			},
+		},
+		"ReplaceMap": {
+			reason: "A scalar replacing a map should drop the origins of all the values nested under it",
+			args: args{
+				layers: []envLayer{
+					{kind: layerKindContext, data: map[string]any{
+						"a": map[string]any{"b": "from-context", "c": map[string]any{"d": "from-context"}},
+					}},
+					{kind: layerKindEnvironmentConfig, name: "foo", data: map[string]any{
+						"a": "from-foo",
+					}},
+				},
+			},
+			want: want{
+				merged: map[string]any{
+					"a": "from-foo",
+				},
+				provenance: map[string]any{
+					"a": map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+				},
+				typeChanges: []typeChange{
+					{
+						path:     "a",
+						from:     "object",
+						to:       "string",
+						previous: []origin{{kind: layerKindContext}},
+						origin:   origin{kind: layerKindEnvironmentConfig, name: "foo"},
+					},
+				},
+			},
+		},
+		"ToFieldPathAndSpecialKeys": {
+			reason: "Layers should be loaded at their toFieldPath, and keys containing dots should use the bracket notation",
+			args: args{
+				layers: []envLayer{
+					{kind: layerKindEnvironmentConfig, name: "foo", toFieldPath: "labels", data: map[string]any{
+						"example.org/team": "from-foo",
+						"empty":            map[string]any{},
+					}},
+				},
+			},
+			want: want{
+				merged: map[string]any{
+					"labels": map[string]any{"example.org/team": "from-foo", "empty": map[string]any{}},
+				},
+				provenance: map[string]any{
+					"labels[example.org/team]": map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+					"labels.empty":             map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+				},
+			},
+		},
+		"Conflicts": {
+			reason: "Different values set by different EnvironmentConfig layers for the same path should be recorded as conflicts",
+			args: args{
+				layers: []envLayer{
+					{kind: layerKindDefaultData, data: map[string]any{
+						"a": "from-default",
+					}},
+					{kind: layerKindEnvironmentConfig, source: 0, name: "foo", data: map[string]any{
+						"a": "from-foo",
+						"b": "same",
+						"c": map[string]any{"d": "from-foo"},
+					}},
+					{kind: layerKindEnvironmentConfig, source: 1, name: "bar", data: map[string]any{
+						"b": "same",
+						"c": "from-bar",
+					}},
+				},
+			},
+			want: want{
+				merged: map[string]any{
+					"a": "from-foo",
+					"b": "same",
+					"c": "from-bar",
+				},
+				provenance: map[string]any{
+					"a": map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+					"b": map[string]any{"layer": "EnvironmentConfig", "source": int64(1), "name": "bar"},
+					"c": map[string]any{"layer": "EnvironmentConfig", "source": int64(1), "name": "bar"},
+				},
+				conflicts: []conflict{
+					{
+						path:     "c",
+						previous: []origin{{kind: layerKindEnvironmentConfig, source: 0, name: "foo"}},
+						origin:   origin{kind: layerKindEnvironmentConfig, source: 1, name: "bar"},
+					},
+				},
+				typeChanges: []typeChange{
+					{
+						path:     "c",
+						from:     "object",
+						to:       "string",
+						previous: []origin{{kind: layerKindEnvironmentConfig, source: 0, name: "foo"}},
+						origin:   origin{kind: layerKindEnvironmentConfig, source: 1, name: "bar"},
+					},
+				},
+			},
+		},
+		"TypeChanges": {
+			reason: "Values overridden by values of a different JSON type should be recorded as type changes, null being compatible with any type",
+			args: args{
+				layers: []envLayer{
+					{kind: layerKindDefaultData, data: map[string]any{
+						"network": map[string]any{"cidr": "10.0.0.0/16"},
+						"count":   int64(1),
+						"unset":   nil,
+					}},
+					{kind: layerKindEnvironmentConfig, name: "foo", data: map[string]any{
+						"network": "default",
+						"count":   1.5,
+						"unset":   "set",
+					}},
+				},
+			},
+			want: want{
+				merged: map[string]any{
+					"network": "default",
+					"count":   1.5,
+					"unset":   "set",
+				},
+				provenance: map[string]any{
+					"network": map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+					"count":   map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+					"unset":   map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+				},
+				typeChanges: []typeChange{
+					{
+						path:     "network",
+						from:     "object",
+						to:       "string",
+						previous: []origin{{kind: layerKindDefaultData}},
+						origin:   origin{kind: layerKindEnvironmentConfig, name: "foo"},
+					},
+				},
+			},
+		},
+		"Tombstones": {
+			reason: "Tombstones should delete the keys they are set for and any value nested under them, and should not be kept if there is nothing to delete",
+			args: args{
+				opts: mergeOptions{deleteSentinel: "~delete"},
+				layers: []envLayer{
+					{kind: layerKindDefaultData, data: map[string]any{
+						"a": map[string]any{"b": "from-default", "c": "from-default"},
+						"d": "from-default",
+						"e": "from-default",
+					}},
+					{kind: layerKindEnvironmentConfig, name: "foo", data: map[string]any{
+						"a": map[string]any{"b": map[string]any{"$patch": "delete"}},
+						"d": "~delete",
+						"f": map[string]any{"g": "~delete", "h": "from-foo"},
+					}},
+				},
+			},
+			want: want{
+				merged: map[string]any{
+					"a": map[string]any{"c": "from-default"},
+					"e": "from-default",
+					"f": map[string]any{"h": "from-foo"},
+				},
+				provenance: map[string]any{
+					"a.c": map[string]any{"layer": "DefaultData"},
+					"e":   map[string]any{"layer": "DefaultData"},
+					"f.h": map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+				},
+			},
+		},
+		"ListMerges": {
+			reason: "Lists should be merged according to the configuration for their path, replaced as a whole otherwise",
+			args: args{
+				opts: mergeOptions{listMerges: map[string]v1beta1.ListMerge{
+					"network.subnets": {Path: "network.subnets", MergeKey: ptr.To("name")},
+					"tags":            {Path: "tags", Behavior: ptr.To(v1beta1.ListMergeBehaviorAppend)},
+				}},
+				layers: []envLayer{
+					{kind: layerKindDefaultData, data: map[string]any{
+						"network": map[string]any{"subnets": []any{
+							map[string]any{"name": "a", "cidr": "10.0.0.0/24", "public": true},
+							map[string]any{"name": "b", "cidr": "10.0.1.0/24"},
+							map[string]any{"name": "c", "cidr": "10.0.2.0/24"},
+						}},
+						"tags":  []any{"a"},
+						"zones": []any{"a", "b"},
+					}},
+					{kind: layerKindEnvironmentConfig, name: "foo", data: map[string]any{
+						"network": map[string]any{"subnets": []any{
+							map[string]any{"name": "a", "cidr": "10.1.0.0/24"},
+							map[string]any{"name": "c", "$patch": "delete"},
+							map[string]any{"name": "d", "cidr": "10.1.3.0/24"},
+						}},
+						"tags":  []any{"b"},
+						"zones": []any{"c"},
+					}},
+				},
+			},
+			want: want{
+				merged: map[string]any{
+					"network": map[string]any{"subnets": []any{
+						map[string]any{"name": "a", "cidr": "10.1.0.0/24", "public": true},
+						map[string]any{"name": "b", "cidr": "10.0.1.0/24"},
+						map[string]any{"name": "d", "cidr": "10.1.3.0/24"},
+					}},
+					"tags":  []any{"a", "b"},
+					"zones": []any{"c"},
+				},
+				provenance: map[string]any{
+					"network.subnets": map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+					"tags":            map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+					"zones":           map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+				},
+			},
+		},
+		"NestedListMerges": {
+			reason: "Lists nested in items merged by key should be merged according to the configuration for their own path only",
+			args: args{
+				opts: mergeOptions{listMerges: map[string]v1beta1.ListMerge{
+					"subnets":        {Path: "subnets", MergeKey: ptr.To("name")},
+					"subnets[].tags": {Path: "subnets[].tags", Behavior: ptr.To(v1beta1.ListMergeBehaviorAppend)},
+				}},
+				layers: []envLayer{
+					{kind: layerKindDefaultData, data: map[string]any{
+						"subnets": []any{
+							map[string]any{"name": "a", "tags": []any{"x"}, "zones": []any{"a"}},
+						},
+						"tags": []any{"x"},
+					}},
+					{kind: layerKindEnvironmentConfig, name: "foo", data: map[string]any{
+						"subnets": []any{
+							map[string]any{"name": "a", "tags": []any{"y"}, "zones": []any{"b"}},
+						},
+						"tags": []any{"y"},
+					}},
+				},
+			},
+			want: want{
+				merged: map[string]any{
+					"subnets": []any{
+						map[string]any{"name": "a", "tags": []any{"x", "y"}, "zones": []any{"b"}},
+					},
+					"tags": []any{"y"},
+				},
+				provenance: map[string]any{
+					"subnets": map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+					"tags":    map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			opts := tc.args.opts
+			opts.trackOrigins = true
+			m := newMerger(opts)
+			merged, err := mergeEnvConfigsData(m, nil, tc.args.layers)
+			if err != nil {
+				t.Fatalf("%s\nmergeEnvConfigsData(...): unexpected error: %s", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.merged, merged); diff != "" {
+				t.Errorf("%s\nmergeEnvConfigsData(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.provenance, m.provenance()); diff != "" {
+				t.Errorf("%s\nm.provenance(): -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.conflicts, m.conflicts, cmp.AllowUnexported(conflict{}, origin{})); diff != "" {
+				t.Errorf("%s\nm.conflicts: -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.typeChanges, m.typeChanges, cmp.AllowUnexported(typeChange{}, origin{})); diff != "" {
+				t.Errorf("%s\nm.typeChanges: -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestFillMissing(t *testing.T) {
+	foo := origin{kind: layerKindEnvironmentConfig, name: "foo"}
+
+	type args struct {
+		dst map[string]any
+		src map[string]any
+	}
+	type want struct {
+		filled     map[string]any
+		provenance map[string]any
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"FillNested": {
+			reason: "Only values missing in dst should be set, including inside nested maps, values of dst should never be overridden",
+			args: args{
+				dst: map[string]any{
+					"a": "from-context",
+					"b": map[string]any{"c": "from-context"},
+					"d": map[string]any{"e": "from-context"},
+				},
+				src: map[string]any{
+					"a": "from-foo",
+					"b": map[string]any{"c": "from-foo", "f": "from-foo"},
+					"d": "from-foo",
+					"g": []any{"from-foo"},
+				},
+			},
+			want: want{
+				filled: map[string]any{
+					"a": "from-context",
+					"b": map[string]any{"c": "from-context", "f": "from-foo"},
+					"d": map[string]any{"e": "from-context"},
+					"g": []any{"from-foo"},
+				},
+				provenance: map[string]any{
+					"a":   map[string]any{"layer": "Context"},
+					"b.c": map[string]any{"layer": "Context"},
+					"b.f": map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+					"d.e": map[string]any{"layer": "Context"},
+					"g":   map[string]any{"layer": "EnvironmentConfig", "source": int64(0), "name": "foo"},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := newMerger(mergeOptions{trackOrigins: true})
+			src := m.merge(map[string]any{}, tc.args.src, foo)
+			filled := m.fillMissing(tc.args.dst, src, origin{kind: layerKindContext})
+			if diff := cmp.Diff(tc.want.filled, filled); diff != "" {
+				t.Errorf("%s\nm.fillMissing(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.provenance, m.provenance()); diff != "" {
+				t.Errorf("%s\nm.provenance(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestMergeUntracked(t *testing.T) {
+	m := newMerger(mergeOptions{})
+	merged := m.merge(
+		map[string]any{"a": map[string]any{"b": "foo"}},
+		map[string]any{"a": map[string]any{"b": int64(1), "c": "bar"}},
+		origin{kind: layerKindEnvironmentConfig, name: "bar"},
+	)
+	if diff := cmp.Diff(map[string]any{"a": map[string]any{"b": int64(1), "c": "bar"}}, merged); diff != "" {
+		t.Errorf("m.merge(...): -want, +got:\n%s", diff)
+	}
+	if len(m.provenance()) > 0 || len(m.conflicts) > 0 || len(m.typeChanges) > 0 {
+		t.Errorf("m.merge(...): origins should not be tracked, got provenance %v, conflicts %v, type changes %v", m.provenance(), m.conflicts, m.typeChanges)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/function-sdk-go/resource/composed"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+// buildOutput returns the ConfigMap or Secret the supplied environment should
+// be emitted as.
+func buildOutput(o *v1beta1.Output, env map[string]any) (*composed.Unstructured, error) {
+	var data any = environmentData(env)
+	if o.FromFieldPath != nil {
+		v, err := fieldpath.Pave(env).GetValue(*o.FromFieldPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get environment field %q", *o.FromFieldPath)
+		}
+		data = v
+	}
+
+	values := map[string]string{}
+	switch o.GetFormat() {
+	case v1beta1.OutputFormatFlatten:
+		m, ok := data.(map[string]any)
+		if !ok {
+			return nil, errors.Errorf("cannot flatten environment: expected an object, got %T", data)
+		}
+		if err := flatten(values, "", m); err != nil {
+			return nil, errors.Wrap(err, "cannot flatten environment")
+		}
+	case v1beta1.OutputFormatJSON:
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot marshal environment to JSON")
+		}
+		values[o.GetKey()] = string(raw)
+	case v1beta1.OutputFormatYAML:
+		raw, err := yaml.Marshal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot marshal environment to YAML")
+		}
+		values[o.GetKey()] = string(raw)
+	default:
+		return nil, errors.Errorf("unknown output format %q", o.GetFormat())
+	}
+
+	out := composed.New()
+	out.SetAPIVersion("v1")
+	out.SetKind(string(o.GetKind()))
+	out.SetName(ptr.Deref(o.Name, ""))
+	out.SetNamespace(ptr.Deref(o.Namespace, ""))
+	if len(o.Labels) > 0 {
+		out.SetLabels(o.Labels)
+	}
+	content := make(map[string]any, len(values))
+	for k, v := range values {
+		if o.GetKind() == v1beta1.OutputKindSecret {
+			v = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		content[k] = v
+	}
+	out.Object["data"] = content
+	return out, nil
+}
+
+// flatten writes to out a key for each leaf value of the supplied object,
+// joining the keys of nested objects with dots. Strings are written as is,
+// any other value as JSON.
+func flatten(out map[string]string, prefix string, m map[string]any) error {
+	for k, v := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]any); ok {
+			if err := flatten(out, key, nested); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := out[key]; ok {
+			return errors.Errorf("key %q set more than once", key)
+		}
+		s, ok := v.(string)
+		if !ok {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return errors.Wrapf(err, "cannot marshal value of key %q", key)
+			}
+			s = string(raw)
+		}
+		out[key] = s
+	}
+	return nil
+}
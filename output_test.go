@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+func TestBuildOutput(t *testing.T) {
+	env := map[string]any{
+		"apiVersion": "internal.crossplane.io/v1alpha1",
+		"kind":       "Environment",
+		"network": map[string]any{
+			"cidr":    "10.0.0.0/16",
+			"nat":     true,
+			"subnets": []any{"a", "b"},
+		},
+		"region": "eu-west-1",
+	}
+
+	type args struct {
+		o   *v1beta1.Output
+		env map[string]any
+	}
+	type want struct {
+		obj map[string]any
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"FlattenConfigMap": {
+			reason: "The environment should be flattened into a ConfigMap by default, omitting its apiVersion and kind",
+			args: args{
+				o: &v1beta1.Output{
+					Name:      ptr.To("example"),
+					Namespace: ptr.To("default"),
+					Labels:    map[string]string{"app": "example"},
+				},
+				env: env,
+			},
+			want: want{
+				obj: map[string]any{
+					"apiVersion": "v1",
+					"kind":       "ConfigMap",
+					"metadata": map[string]any{
+						"name":      "example",
+						"namespace": "default",
+						"labels":    map[string]any{"app": "example"},
+					},
+					"data": map[string]any{
+						"network.cidr":    "10.0.0.0/16",
+						"network.nat":     "true",
+						"network.subnets": `["a","b"]`,
+						"region":          "eu-west-1",
+					},
+				},
+			},
+		},
+		"JSONSecretSubtree": {
+			reason: "A subtree of the environment should be written as a base64 encoded JSON document to a Secret",
+			args: args{
+				o: &v1beta1.Output{
+					Kind:          ptr.To(v1beta1.OutputKindSecret),
+					FromFieldPath: ptr.To("network.subnets"),
+					Format:        ptr.To(v1beta1.OutputFormatJSON),
+				},
+				env: env,
+			},
+			want: want{
+				obj: map[string]any{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"data": map[string]any{
+						// ["a","b"]
+						"environment.json": "WyJhIiwiYiJd",
+					},
+				},
+			},
+		},
+		"YAMLCustomKey": {
+			reason: "A subtree of the environment should be written as a YAML document at the requested key",
+			args: args{
+				o: &v1beta1.Output{
+					FromFieldPath: ptr.To("network"),
+					Format:        ptr.To(v1beta1.OutputFormatYAML),
+					Key:           ptr.To("values.yaml"),
+				},
+				env: env,
+			},
+			want: want{
+				obj: map[string]any{
+					"apiVersion": "v1",
+					"kind":       "ConfigMap",
+					"data": map[string]any{
+						"values.yaml": "cidr: 10.0.0.0/16\nnat: true\nsubnets:\n- a\n- b\n",
+					},
+				},
+			},
+		},
+		"FlattenNonObject": {
+			reason: "Flattening a subtree that is not an object should return an error",
+			args: args{
+				o:   &v1beta1.Output{FromFieldPath: ptr.To("region")},
+				env: env,
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"FlattenDuplicateKey": {
+			reason: "Flattening an environment resulting in the same key more than once should return an error",
+			args: args{
+				o: &v1beta1.Output{},
+				env: map[string]any{
+					"a.b": "from-dotted",
+					"a":   map[string]any{"b": "from-nested"},
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := buildOutput(tc.args.o, tc.args.env)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nbuildOutput(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			var obj map[string]any
+			if got != nil {
+				obj = got.Object
+			}
+			if diff := cmp.Diff(tc.want.obj, obj); diff != "" {
+				t.Errorf("%s\nbuildOutput(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
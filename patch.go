@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	k8sjson "k8s.io/apimachinery/pkg/util/json"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+// applyPatches applies the patches held by the supplied layers, in order,
+// followed by the inline JSON patch operations, to the environment, returning
+// the result. The origins of the patched values are tracked by the merger.
+func applyPatches(m *merger, env map[string]any, layers []envLayer, ops []v1beta1.JSONPatchOperation) (map[string]any, error) {
+	for _, l := range layers {
+		doc, err := json.Marshal(l.data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot marshal patch from environment config %q", l.name)
+		}
+		env, err = applyPatch(m, env, l.patchType, doc, origin{kind: layerKindPatch, source: l.source, name: l.name})
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot apply patch from environment config %q", l.name)
+		}
+	}
+	if len(ops) == 0 {
+		return env, nil
+	}
+	doc, err := json.Marshal(ops)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal inline patches")
+	}
+	env, err = applyPatch(m, env, v1beta1.PatchTypeJSONPatch, doc, origin{kind: layerKindPatch})
+	return env, errors.Wrap(err, "cannot apply inline patches")
+}
+
+// applyPatch applies a JSON patch or a JSON merge patch to the environment,
+// returning the result.
+func applyPatch(m *merger, env map[string]any, t v1beta1.PatchType, patch []byte, o origin) (map[string]any, error) {
+	doc, err := json.Marshal(env)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal environment")
+	}
+	var patched []byte
+	switch t {
+	case v1beta1.PatchTypeJSONPatch:
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decode JSON patch")
+		}
+		if patched, err = p.Apply(doc); err != nil {
+			return nil, err
+		}
+	case v1beta1.PatchTypeMergePatch:
+		if patched, err = jsonpatch.MergePatch(doc, patch); err != nil {
+			return nil, err
+		}
+	default:
+		// should never happen
+		return nil, errors.Errorf("unknown patch type %q", t)
+	}
+	out := map[string]any{}
+	if err := k8sjson.Unmarshal(patched, &out); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal patched environment")
+	}
+	m.track("", env, out, o)
+	return out, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+func TestApplyPatches(t *testing.T) {
+	type args struct {
+		env    map[string]any
+		layers []envLayer
+		ops    []v1beta1.JSONPatchOperation
+	}
+	type want struct {
+		env        map[string]any
+		provenance map[string]any
+		err        error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"PatchesFromEnvironmentConfigs": {
+			reason: "Patches from EnvironmentConfigs should be applied in order, tracking the origin of the patched values",
+			args: args{
+				env: map[string]any{
+					"network": map[string]any{"cidr": "10.0.0.0/16", "nat": true},
+					"region":  "eu-west-1",
+				},
+				layers: []envLayer{
+					{name: "json", source: 1, patchType: v1beta1.PatchTypeJSONPatch, data: []any{
+						map[string]any{"op": "replace", "path": "/network/cidr", "value": "10.1.0.0/16"},
+						map[string]any{"op": "copy", "from": "/region", "path": "/primaryRegion"},
+					}},
+					{name: "merge", source: 2, patchType: v1beta1.PatchTypeMergePatch, data: map[string]any{
+						"network": map[string]any{"nat": nil, "zones": int64(3)},
+					}},
+				},
+			},
+			want: want{
+				env: map[string]any{
+					"network":       map[string]any{"cidr": "10.1.0.0/16", "zones": int64(3)},
+					"region":        "eu-west-1",
+					"primaryRegion": "eu-west-1",
+				},
+				provenance: map[string]any{
+					"network.cidr":  map[string]any{"layer": "Patch", "source": int64(1), "name": "json"},
+					"primaryRegion": map[string]any{"layer": "Patch", "source": int64(1), "name": "json"},
+					"network.zones": map[string]any{"layer": "Patch", "source": int64(2), "name": "merge"},
+				},
+			},
+		},
+		"InlinePatches": {
+			reason: "Inline JSON patch operations should be applied after the patches from EnvironmentConfigs",
+			args: args{
+				env: map[string]any{"region": "eu-west-1"},
+				layers: []envLayer{
+					{name: "merge", patchType: v1beta1.PatchTypeMergePatch, data: map[string]any{"region": "us-east-1"}},
+				},
+				ops: []v1beta1.JSONPatchOperation{
+					{Op: v1beta1.JSONPatchOpTest, Path: "/region", Value: &extv1.JSON{Raw: []byte(`"us-east-1"`)}},
+					{Op: v1beta1.JSONPatchOpAdd, Path: "/zones", Value: &extv1.JSON{Raw: []byte(`["a","b"]`)}},
+					{Op: v1beta1.JSONPatchOpMove, From: ptr.To("/region"), Path: "/primaryRegion"},
+				},
+			},
+			want: want{
+				env: map[string]any{
+					"primaryRegion": "us-east-1",
+					"zones":         []any{"a", "b"},
+				},
+				provenance: map[string]any{
+					"primaryRegion": map[string]any{"layer": "Patch"},
+					"zones":         map[string]any{"layer": "Patch"},
+				},
+			},
+		},
+		"FailedTest": {
+			reason: "A failing test operation should return an error",
+			args: args{
+				env: map[string]any{"region": "eu-west-1"},
+				ops: []v1beta1.JSONPatchOperation{
+					{Op: v1beta1.JSONPatchOpTest, Path: "/region", Value: &extv1.JSON{Raw: []byte(`"us-east-1"`)}},
+				},
+			},
+			want: want{
+				err:        cmpopts.AnyError,
+				provenance: map[string]any{},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := newMerger(mergeOptions{trackOrigins: true})
+			got, err := applyPatches(m, tc.args.env, tc.args.layers, tc.args.ops)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\napplyPatches(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.env, got); diff != "" {
+				t.Errorf("%s\napplyPatches(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.provenance, m.provenance()); diff != "" {
+				t.Errorf("%s\nm.provenance(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
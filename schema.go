@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+// getSchema returns the schema the supplied environment should be validated
+// against, either inline or from the referenced EnvironmentConfig.
+func getSchema(env environment, requiredResources map[string][]resource.Required) (*spec.Schema, error) {
+	s := env.spec.Schema
+	var raw []byte
+	switch {
+	case s.Inline != nil:
+		raw = s.Inline.Raw
+	case s.Ref != nil:
+		resources := requiredResources[env.schemaRequirementName()]
+		if len(resources) == 0 {
+			return nil, errors.Errorf("Required environment config %q not found", s.Ref.Name)
+		}
+		v, err := fieldpath.Pave(resources[0].Resource.Object).GetValue(s.Ref.GetFieldPath())
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get schema at %q from environment config %q", s.Ref.GetFieldPath(), s.Ref.Name)
+		}
+		if raw, err = json.Marshal(v); err != nil {
+			return nil, errors.Wrapf(err, "cannot marshal schema from environment config %q", s.Ref.Name)
+		}
+	default:
+		return nil, errors.New("either inline or ref is required")
+	}
+	out := &spec.Schema{}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return nil, errors.Wrap(err, "cannot parse schema")
+	}
+	return out, nil
+}
+
+// validateSchema returns all the violations of the supplied schema by data,
+// sorted.
+func validateSchema(s *spec.Schema, data map[string]any) []string {
+	res := validate.NewSchemaValidator(s, nil, "", strfmt.Default).Validate(data)
+	out := make([]string, 0, len(res.Errors))
+	for _, err := range res.Errors {
+		// Violations at the root of the environment are reported as ".key".
+		out = append(out, strings.TrimPrefix(err.Error(), "."))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkRequiredKeys returns the description of all the required keys not set
+// in the supplied environment, or set to a value of the wrong type or not
+// matching their pattern.
+func checkRequiredKeys(keys []v1beta1.RequiredKey, env map[string]any) ([]string, error) {
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v, err := fieldpath.Pave(env).GetValue(k.FieldPath)
+		if err != nil && !fieldpath.IsNotFound(err) {
+			return nil, errors.Wrapf(err, "cannot get required key %q", k.FieldPath)
+		}
+		if v == nil {
+			out = append(out, fmt.Sprintf("%q: missing", k.FieldPath))
+			continue
+		}
+		if k.Type != nil && !hasType(v, *k.Type) {
+			out = append(out, fmt.Sprintf("%q: expected %s, got %s", k.FieldPath, *k.Type, jsonType(v)))
+			continue
+		}
+		if k.Pattern == nil {
+			continue
+		}
+		re, err := regexp.Compile(*k.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern of required key %q", k.FieldPath)
+		}
+		// The value itself is not reported, as it might be a secret.
+		if s, ok := v.(string); !ok || !re.MatchString(s) {
+			out = append(out, fmt.Sprintf("%q: %s value does not match %q", k.FieldPath, jsonType(v), *k.Pattern))
+		}
+	}
+	return out, nil
+}
+
+// hasType returns true if the supplied value has the supplied type.
+func hasType(v any, t v1beta1.RequiredKeyType) bool {
+	switch t {
+	case v1beta1.RequiredKeyTypeInteger:
+		if f, ok := v.(float64); ok {
+			return f == math.Trunc(f)
+		}
+		_, ok := v.(int64)
+		return ok
+	case v1beta1.RequiredKeyTypeString, v1beta1.RequiredKeyTypeNumber, v1beta1.RequiredKeyTypeBoolean, v1beta1.RequiredKeyTypeObject, v1beta1.RequiredKeyTypeArray:
+		return strings.EqualFold(jsonType(v), string(t))
+	default:
+		return false
+	}
+}
+
+// describeSources returns a human readable list of the origins of the
+// supplied layers.
+func describeSources(layers []envLayer) string {
+	if len(layers) == 0 {
+		return "none"
+	}
+	out := make([]string, 0, len(layers))
+	for _, l := range layers {
+		if s := originOf(l).String(); !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, ", ")
+}
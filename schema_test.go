@@ -0,0 +1,237 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane-contrib/function-environment-configs/input/v1beta1"
+)
+
+func TestGetSchema(t *testing.T) {
+	holder := resource.Required{Resource: &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{"name": "schemas"},
+		"data": map[string]any{
+			"network": map[string]any{"type": "object", "required": []any{"cidr"}},
+		},
+	}}}
+
+	type args struct {
+		env               environment
+		requiredResources map[string][]resource.Required
+	}
+	type want struct {
+		required []string
+		err      error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Inline": {
+			reason: "An inline schema should be parsed",
+			args: args{
+				env: environment{spec: &v1beta1.EnvironmentSpec{Schema: &v1beta1.Schema{
+					Inline: &extv1.JSON{Raw: []byte(`{"type": "object", "required": ["region"]}`)},
+				}}},
+			},
+			want: want{
+				required: []string{"region"},
+			},
+		},
+		"Ref": {
+			reason: "A schema should be read at the requested field path of the referenced EnvironmentConfig",
+			args: args{
+				env: environment{name: "network", spec: &v1beta1.EnvironmentSpec{Schema: &v1beta1.Schema{
+					Ref: &v1beta1.SchemaReference{Name: "schemas", FieldPath: ptr.To("data.network")},
+				}}},
+				requiredResources: map[string][]resource.Required{
+					"environment-network-schema": {holder},
+				},
+			},
+			want: want{
+				required: []string{"cidr"},
+			},
+		},
+		"RefNotFound": {
+			reason: "A referenced EnvironmentConfig not found should return an error",
+			args: args{
+				env: environment{spec: &v1beta1.EnvironmentSpec{Schema: &v1beta1.Schema{
+					Ref: &v1beta1.SchemaReference{Name: "schemas"},
+				}}},
+				requiredResources: map[string][]resource.Required{
+					"environment-schema": {},
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := getSchema(tc.args.env, tc.args.requiredResources)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\ngetSchema(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			var required []string
+			if got != nil {
+				required = got.Required
+			}
+			if diff := cmp.Diff(tc.want.required, required); diff != "" {
+				t.Errorf("%s\ngetSchema(...): -want required, +got required:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := v1beta1.Schema{Inline: &extv1.JSON{Raw: []byte(`{
+		"type": "object",
+		"required": ["region", "account"],
+		"properties": {
+			"network": {
+				"type": "object",
+				"properties": {
+					"cidr": {"type": "string", "pattern": "^10\\."}
+				}
+			},
+			"replicas": {"type": "integer", "minimum": 1}
+		}
+	}`)}}
+
+	cases := map[string]struct {
+		reason string
+		data   map[string]any
+		want   []string
+	}{
+		"Valid": {
+			reason: "Data matching the schema should have no violations",
+			data: map[string]any{
+				"region":   "eu-west-1",
+				"account":  "123",
+				"network":  map[string]any{"cidr": "10.0.0.0/16"},
+				"replicas": int64(3),
+			},
+			want: []string{},
+		},
+		"Violations": {
+			reason: "All violations should be returned with their field paths, sorted",
+			data: map[string]any{
+				"region":   "eu-west-1",
+				"network":  map[string]any{"cidr": int64(10)},
+				"replicas": int64(0),
+			},
+			want: []string{
+				`account in body is required`,
+				`network.cidr in body must be of type string: "integer"`,
+				`replicas in body should be greater than or equal to 1`,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s, err := getSchema(environment{spec: &v1beta1.EnvironmentSpec{Schema: &schema}}, nil)
+			if err != nil {
+				t.Fatalf("getSchema(...): %v", err)
+			}
+			got := validateSchema(s, tc.data)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nvalidateSchema(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCheckRequiredKeys(t *testing.T) {
+	env := map[string]any{
+		"network": map[string]any{"vpcId": "vpc-123", "cidr": "10.0.0.0/16"},
+		"account": map[string]any{"id": "abc", "replicas": float64(3), "ratio": 0.5},
+		"nothing": nil,
+	}
+
+	type args struct {
+		keys []v1beta1.RequiredKey
+		env  map[string]any
+	}
+	type want struct {
+		violations []string
+		err        error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Satisfied": {
+			reason: "Keys set to values of the expected type and matching their pattern should not be reported",
+			args: args{
+				keys: []v1beta1.RequiredKey{
+					{FieldPath: "network.vpcId", Type: ptr.To(v1beta1.RequiredKeyTypeString), Pattern: ptr.To("^vpc-")},
+					{FieldPath: "network"},
+					{FieldPath: "account.replicas", Type: ptr.To(v1beta1.RequiredKeyTypeInteger)},
+					{FieldPath: "account.ratio", Type: ptr.To(v1beta1.RequiredKeyTypeNumber)},
+				},
+				env: env,
+			},
+			want: want{
+				violations: []string{},
+			},
+		},
+		"Violations": {
+			reason: "Every key missing, null, of the wrong type or not matching its pattern should be reported",
+			args: args{
+				keys: []v1beta1.RequiredKey{
+					{FieldPath: "network.subnetId"},
+					{FieldPath: "nothing"},
+					{FieldPath: "account.ratio", Type: ptr.To(v1beta1.RequiredKeyTypeInteger)},
+					{FieldPath: "network", Type: ptr.To(v1beta1.RequiredKeyTypeString)},
+					{FieldPath: "account.id", Pattern: ptr.To("^[0-9]+$")},
+				},
+				env: env,
+			},
+			want: want{
+				violations: []string{
+					`"network.subnetId": missing`,
+					`"nothing": missing`,
+					`"account.ratio": expected Integer, got number`,
+					`"network": expected String, got object`,
+					`"account.id": string value does not match "^[0-9]+$"`,
+				},
+			},
+		},
+		"InvalidPattern": {
+			reason: "An invalid pattern should return an error",
+			args: args{
+				keys: []v1beta1.RequiredKey{{FieldPath: "account.id", Pattern: ptr.To("(")}},
+				env:  env,
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := checkRequiredKeys(tc.args.keys, tc.args.env)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\ncheckRequiredKeys(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.violations, got); diff != "" {
+				t.Errorf("%s\ncheckRequiredKeys(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// sopsMetadataKey is the key of the SOPS metadata in a SOPS encrypted
+	// object.
+	sopsMetadataKey = "sops"
+
+	// redacted replaces decrypted values in logs.
+	redacted = "<redacted>"
+)
+
+// sopsValue matches a value encrypted by SOPS.
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// A decrypter decrypts the SOPS encrypted objects found in the data of
+// EnvironmentConfigs, whose data key is encrypted with age.
+type decrypter struct {
+	identities []age.Identity
+
+	// decrypted are the decrypted values, redacted wherever they end up.
+	decrypted []any
+}
+
+// decrypt returns the supplied value, found at path of the environment, with
+// all the SOPS encrypted objects it holds decrypted, i.e. objects with a
+// `sops` key holding their metadata, as recognized by isSOPSMetadata. The
+// SOPS message authentication code is not verified, as the order of the keys
+// it depends on is not preserved.
+func (d *decrypter) decrypt(v any, path string) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		if meta, ok := v[sopsMetadataKey].(map[string]any); ok && isSOPSMetadata(meta) {
+			out, err := d.decryptObject(v, meta, path)
+			if err != nil {
+				return nil, err
+			}
+			return out, nil
+		}
+		out := make(map[string]any, len(v))
+		for k, nested := range v {
+			dv, err := d.decrypt(nested, appendPath(path, k))
+			if err != nil {
+				return nil, err
+			}
+			out[k] = dv
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, nested := range v {
+			dv, err := d.decrypt(nested, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = dv
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// isSOPSMetadata returns true if the supplied map looks like the metadata of
+// an object encrypted by SOPS for age recipients, i.e. it has a message
+// authentication code, a version and a list of age recipients.
+func isSOPSMetadata(meta map[string]any) bool {
+	_, hasMAC := meta["mac"].(string)
+	_, hasVersion := meta["version"].(string)
+	recipients, _ := meta["age"].([]any)
+	return hasMAC && hasVersion && len(recipients) > 0
+}
+
+// decryptObject decrypts the values of the supplied SOPS encrypted object,
+// dropping its metadata.
+func (d *decrypter) decryptObject(obj, meta map[string]any, path string) (map[string]any, error) {
+	key, err := d.dataKey(meta)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get data key of %q", path)
+	}
+	out := make(map[string]any, len(obj))
+	for k, v := range obj {
+		if k == sopsMetadataKey {
+			continue
+		}
+		dv, err := d.decryptValue(v, key, appendPath(path, k), []string{k})
+		if err != nil {
+			return nil, err
+		}
+		out[k] = dv
+	}
+	return out, nil
+}
+
+// decryptValue decrypts the encrypted values held by the supplied value,
+// found at path of the environment and at keys of the encrypted object.
+func (d *decrypter) decryptValue(v any, key []byte, path string, keys []string) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, nested := range v {
+			dv, err := d.decryptValue(nested, key, appendPath(path, k), append(keys[:len(keys):len(keys)], k))
+			if err != nil {
+				return nil, err
+			}
+			out[k] = dv
+		}
+		return out, nil
+	case []any:
+		// SOPS authenticates the items of lists with the path of the list.
+		out := make([]any, len(v))
+		for i, nested := range v {
+			dv, err := d.decryptValue(nested, key, fmt.Sprintf("%s[%d]", path, i), keys)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = dv
+		}
+		return out, nil
+	case string:
+		if !sopsValue.MatchString(v) {
+			return v, nil
+		}
+		dv, err := decryptSOPSValue(v, key, strings.Join(keys, ":")+":")
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot decrypt value of %q", path)
+		}
+		d.decrypted = append(d.decrypted, dv)
+		return dv, nil
+	default:
+		return v, nil
+	}
+}
+
+// dataKey returns the data key of a SOPS encrypted object, decrypting it with
+// the first age identity able to.
+func (d *decrypter) dataKey(meta map[string]any) ([]byte, error) {
+	if len(d.identities) == 0 {
+		return nil, errors.New("no age identities configured")
+	}
+	recipients, _ := meta["age"].([]any)
+	for _, r := range recipients {
+		rm, _ := r.(map[string]any)
+		enc, _ := rm["enc"].(string)
+		if enc == "" {
+			continue
+		}
+		rd, err := age.Decrypt(armor.NewReader(strings.NewReader(enc)), d.identities...)
+		if err != nil {
+			continue
+		}
+		return io.ReadAll(rd)
+	}
+	return nil, errors.New("no age recipient matches the configured identities")
+}
+
+// redact returns a copy of the supplied environment with the values holding
+// decrypted ones replaced, so that it can be logged. Values are redacted
+// wherever they ended up, e.g. copied by patches or embedded in a string by
+// templates, rather than only where they were decrypted.
+func (d *decrypter) redact(env map[string]any) map[string]any {
+	if d == nil || len(d.decrypted) == 0 {
+		return env
+	}
+	out, _ := d.redactValue(runtime.DeepCopyJSON(env)).(map[string]any)
+	return out
+}
+
+// redactValue replaces the supplied value, or the values nested in it, if
+// they hold a decrypted value. Strings holding a decrypted string, or the
+// string form of another decrypted value, are replaced as a whole.
+func (d *decrypter) redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, nested := range v {
+			v[k] = d.redactValue(nested)
+		}
+		return v
+	case []any:
+		for i, nested := range v {
+			v[i] = d.redactValue(nested)
+		}
+		return v
+	case string:
+		for _, dv := range d.decrypted {
+			if s, ok := dv.(string); ok && s != "" && strings.Contains(v, s) {
+				return redacted
+			}
+			if _, ok := dv.(string); !ok && fmt.Sprint(dv) == v {
+				return redacted
+			}
+		}
+		return v
+	default:
+		for _, dv := range d.decrypted {
+			if _, ok := dv.(string); !ok && fmt.Sprint(dv) == fmt.Sprint(v) {
+				return redacted
+			}
+		}
+		return v
+	}
+}
+
+// decryptSOPSValue decrypts a value encrypted by SOPS with AES256-GCM,
+// authenticated with the supplied additional data, returning it with its
+// original type.
+func decryptSOPSValue(v string, key []byte, additionalData string) (any, error) {
+	m := sopsValue.FindStringSubmatch(v)
+	parts := make([][]byte, 3)
+	for i := range parts {
+		b, err := base64.StdEncoding.DecodeString(m[i+1])
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decode encrypted value")
+		}
+		parts[i] = b
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create cipher")
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create cipher")
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot authenticate encrypted value")
+	}
+
+	switch t := m[4]; t {
+	case "str", "bytes":
+		return string(plain), nil
+	case "int":
+		return strconv.ParseInt(string(plain), 10, 64)
+	case "float":
+		return strconv.ParseFloat(string(plain), 64)
+	case "bool":
+		return strconv.ParseBool(string(plain))
+	default:
+		return nil, errors.Errorf("unsupported encrypted value type %q", t)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/v2/pkg/fieldpath"
+)
+
+// envTemplate is a template held by a string value of the environment.
+type envTemplate struct {
+	// path of the value holding the template.
+	path string
+	tmpl *template.Template
+	// deps are the paths of the environment referenced by the template, an
+	// empty path meaning the whole environment.
+	deps []string
+}
+
+// renderTemplates renders the templates held by the string values of the
+// environment set by EnvironmentConfigs or default data, returning the
+// result. Templates referencing values held by other templates are rendered
+// after them.
+func renderTemplates(m *merger, env, xr map[string]any) (map[string]any, error) {
+	templates := map[string]*envTemplate{}
+	if err := collectTemplates(m, templates, "", "", env); err != nil {
+		return nil, err
+	}
+	order, err := orderTemplates(templates)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range order {
+		var b strings.Builder
+		if err := t.tmpl.Execute(&b, map[string]any{"xr": xr, "env": env}); err != nil {
+			return nil, errors.Wrapf(err, "cannot render template at %q", t.path)
+		}
+		if err := fieldpath.Pave(env).SetValue(t.path, b.String()); err != nil {
+			return nil, errors.Wrapf(err, "cannot set rendered template at %q", t.path)
+		}
+	}
+	return env, nil
+}
+
+// collectTemplates parses the templates held by the string values of the
+// supplied value at path, if set by EnvironmentConfigs or default data.
+// originPath is the path the origin of the value is recorded at, i.e. the
+// path of the enclosing list, if any.
+func collectTemplates(m *merger, out map[string]*envTemplate, path, originPath string, v any) error {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, nested := range v {
+			p := appendPath(path, k)
+			op := originPath
+			if op == path {
+				op = p
+			}
+			if err := collectTemplates(m, out, p, op, nested); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, nested := range v {
+			if err := collectTemplates(m, out, fmt.Sprintf("%s[%d]", path, i), originPath, nested); err != nil {
+				return err
+			}
+		}
+	case string:
+		if !strings.Contains(v, "{{") {
+			return nil
+		}
+		if o, ok := m.lookup(originPath); !ok || (o.kind != layerKindEnvironmentConfig && o.kind != layerKindDefaultData) {
+			return nil
+		}
+		tmpl, err := template.New(path).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return errors.Wrapf(err, "cannot parse template at %q", path)
+		}
+		t := &envTemplate{path: path, tmpl: tmpl}
+		walkTemplate(tmpl.Root, func(n *parse.FieldNode) {
+			if len(n.Ident) == 0 || n.Ident[0] != "env" {
+				return
+			}
+			dep := ""
+			for _, k := range n.Ident[1:] {
+				dep = appendPath(dep, k)
+			}
+			t.deps = append(t.deps, dep)
+		})
+		out[path] = t
+	}
+	return nil
+}
+
+// walkTemplate calls fn for each field node of the supplied template node,
+// e.g. `.env.account.id`.
+func walkTemplate(n parse.Node, fn func(n *parse.FieldNode)) { //nolint:gocyclo // just a switch over the node types
+	switch n := n.(type) {
+	case *parse.FieldNode:
+		fn(n)
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkTemplate(c, fn)
+		}
+	case *parse.ActionNode:
+		walkTemplate(n.Pipe, fn)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			walkTemplate(c, fn)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			walkTemplate(a, fn)
+		}
+	case *parse.ChainNode:
+		walkTemplate(n.Node, fn)
+	case *parse.IfNode:
+		walkTemplate(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walkTemplate(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walkTemplate(&n.BranchNode, fn)
+	case *parse.BranchNode:
+		walkTemplate(n.Pipe, fn)
+		walkTemplate(n.List, fn)
+		walkTemplate(n.ElseList, fn)
+	case *parse.TemplateNode:
+		walkTemplate(n.Pipe, fn)
+	}
+}
+
+// orderTemplates returns the supplied templates ordered so that each is
+// rendered after the templates it references, returning an error on cycles.
+func orderTemplates(templates map[string]*envTemplate) ([]*envTemplate, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(templates))
+	paths := slices.Sorted(maps.Keys(templates))
+	out := make([]*envTemplate, 0, len(templates))
+
+	var visit func(path string, stack []string) error
+	visit = func(path string, stack []string) error {
+		switch state[path] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := slices.Concat(stack[slices.Index(stack, path):], []string{path})
+			return errors.Errorf("templates referencing each other: %s", strings.Join(cycle, " -> "))
+		}
+		state[path] = visiting
+		stack = append(stack, path)
+		t := templates[path]
+		for _, p := range paths {
+			// Templates referencing the whole environment, or a value
+			// enclosing their own, only depend on themselves if they
+			// reference their own path.
+			if p == path && !slices.Contains(t.deps, path) {
+				continue
+			}
+			if dependsOn(t, p) {
+				if err := visit(p, stack); err != nil {
+					return err
+				}
+			}
+		}
+		state[path] = visited
+		out = append(out, t)
+		return nil
+	}
+	for _, p := range paths {
+		if err := visit(p, nil); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// dependsOn returns true if the supplied template references the value at
+// path, or a value nested under or enclosing it.
+func dependsOn(t *envTemplate, path string) bool {
+	return slices.ContainsFunc(t.deps, func(dep string) bool {
+		return dep == "" || isPathUnder(path, dep) || isPathUnder(dep, path)
+	})
+}
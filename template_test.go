@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestRenderTemplates(t *testing.T) {
+	xr := map[string]any{
+		"metadata": map[string]any{"labels": map[string]any{"team": "a"}},
+		"spec":     map[string]any{"region": "eu-west-1"},
+	}
+
+	type args struct {
+		defaultData map[string]any
+		context     map[string]any
+		config      map[string]any
+	}
+	type want struct {
+		env map[string]any
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"RenderInDependencyOrder": {
+			reason: "Templates should be rendered after the templates they reference, including inside lists",
+			args: args{
+				defaultData: map[string]any{
+					"bucket": "{{ .env.prefix }}-logs",
+				},
+				config: map[string]any{
+					"prefix":  "{{ .xr.metadata.labels.team }}",
+					"buckets": []any{"{{ .env.bucket }}-1", map[string]any{"name": "{{ .env.bucket }}-2"}},
+					"region":  "{{ .xr.spec.region }}",
+				},
+			},
+			want: want{
+				env: map[string]any{
+					"prefix":  "a",
+					"bucket":  "a-logs",
+					"buckets": []any{"a-logs-1", map[string]any{"name": "a-logs-2"}},
+					"region":  "eu-west-1",
+				},
+			},
+		},
+		"OnlyEnvironmentConfigsAndDefaultData": {
+			reason: "Templates set by other layers, e.g. the context, should not be rendered",
+			args: args{
+				context: map[string]any{
+					"raw": "{{ .xr.spec.region }}",
+				},
+				config: map[string]any{
+					"region": "{{ .xr.spec.region }}",
+				},
+			},
+			want: want{
+				env: map[string]any{
+					"raw":    "{{ .xr.spec.region }}",
+					"region": "eu-west-1",
+				},
+			},
+		},
+		"Cycle": {
+			reason: "Templates referencing each other should return an error",
+			args: args{
+				config: map[string]any{
+					"a": "{{ .env.b }}",
+					"b": map[string]any{"c": "{{ .env.a }}"},
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"SelfReference": {
+			reason: "A template referencing itself should return an error",
+			args: args{
+				config: map[string]any{
+					"a": "{{ .env.a }}",
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"MissingKey": {
+			reason: "A template referencing a missing key should return an error",
+			args: args{
+				config: map[string]any{
+					"a": "{{ .xr.spec.missing }}",
+				},
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"WholeEnvironment": {
+			reason: "Templates referencing the whole environment, e.g. with index, should be rendered after all the others",
+			args: args{
+				config: map[string]any{
+					"account": map[string]any{"id": "{{ .xr.spec.region }}-123"},
+					"arn":     `{{ index .env "account" "id" }}`,
+				},
+			},
+			want: want{
+				env: map[string]any{
+					"account": map[string]any{"id": "eu-west-1-123"},
+					"arn":     "eu-west-1-123",
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := newMerger(mergeOptions{trackOrigins: true})
+			env := map[string]any{}
+			env = m.merge(env, tc.args.defaultData, origin{kind: layerKindDefaultData})
+			env = m.merge(env, tc.args.context, origin{kind: layerKindContext})
+			env = m.merge(env, tc.args.config, origin{kind: layerKindEnvironmentConfig, name: "foo"})
+			got, err := renderTemplates(m, env, xr)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nrenderTemplates(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.env, got); diff != "" {
+				t.Errorf("%s\nrenderTemplates(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}